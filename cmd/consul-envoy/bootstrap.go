@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"text/template"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// bootstrapConfig is the input for the Envoy bootstrap templates
+type bootstrapConfig struct {
+	DiscoveryHost  string // Host of consul-envoy
+	DiscoveryPort  int    // HTTP port (v1) or xDS gRPC port (v2) of consul-envoy
+	AdminHost      string // Host of the Envoy admin interface
+	AdminPort      int    // Port of the Envoy admin interface
+	LDS            bool   // Use LDS for listeners, instead of a static HTTP listener
+	Delta          bool   // Use incremental (delta) ADS (v2 only)
+	ListenerPort   int    // Port of the static HTTP listener
+	RouteConfig    string // Route config name used by the static HTTP listener
+	ServiceCluster string // Envoy service cluster (v2 only, v1 uses --service-cluster)
+	ServiceNode    string // Envoy service node (v2 only, v1 uses --service-node)
+}
+
+// bootstrapTemplates are the Envoy bootstrap templates, keyed by format
+var bootstrapTemplates = map[string]*template.Template{
+	"v1": template.Must(template.New("v1").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(bootstrapV1)),
+	"v2": template.Must(template.New("v2").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(bootstrapV2)),
+}
+
+// bootstrap will write an Envoy bootstrap configuration using consul-envoy
+// for discovery
+func bootstrap(args []string) error {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	format := flags.String("format", "v2", "bootstrap format, v1 (JSON) or v2 (YAML)")
+	discoveryAddress := flags.String("discovery-address", "", "host:port of consul-envoy (HTTP port for v1, XDS_PORT for v2), resolved from the Consul catalog when empty")
+	discoveryService := flags.String("discovery-service", "consul-envoy", "Consul service name of consul-envoy, used to resolve the discovery address")
+	xdsPort := flags.Int("xds-port", 0, "XDS_PORT of consul-envoy, used for v2 when the discovery address is resolved from the Consul catalog and the service has no \"xds_port\" meta")
+	adminAddress := flags.String("admin-address", "127.0.0.1:9901", "host:port of the Envoy admin interface")
+	lds := flags.Bool("lds", true, "use LDS for listeners, instead of a static HTTP listener")
+	delta := flags.Bool("delta", false, "use incremental (delta) ADS, only sending changed resources (v2 only)")
+	listenerPort := flags.Int("listener-port", 80, "port of the static HTTP listener, when LDS is disabled")
+	routeConfig := flags.String("route-config", "default", "route config name of the static HTTP listener, when LDS is disabled")
+	serviceCluster := flags.String("service-cluster", "", "Envoy service cluster (v2 only)")
+	serviceNode := flags.String("service-node", "", "Envoy service node (v2 only), defaults to the hostname")
+	output := flags.String("output", "", "file to write the bootstrap to, defaults to stdout")
+	flags.Parse(args)
+
+	tmpl, ok := bootstrapTemplates[*format]
+	if !ok {
+		return fmt.Errorf("invalid format %q, must be v1 or v2", *format)
+	}
+
+	config := bootstrapConfig{
+		LDS:            *lds,
+		Delta:          *delta,
+		ListenerPort:   *listenerPort,
+		RouteConfig:    *routeConfig,
+		ServiceCluster: *serviceCluster,
+		ServiceNode:    *serviceNode,
+	}
+
+	var err error
+	if config.AdminHost, config.AdminPort, err = splitAddress(*adminAddress); err != nil {
+		return fmt.Errorf("invalid admin address: %s", err)
+	}
+
+	if *discoveryAddress != "" {
+		if config.DiscoveryHost, config.DiscoveryPort, err = splitAddress(*discoveryAddress); err != nil {
+			return fmt.Errorf("invalid discovery address: %s", err)
+		}
+	} else {
+		if config.DiscoveryHost, config.DiscoveryPort, err = resolveDiscoveryAddress(*discoveryService, *format, *xdsPort); err != nil {
+			return fmt.Errorf("could not resolve discovery address: %s", err)
+		}
+	}
+
+	if config.ServiceNode == "" && *format == "v2" {
+		if config.ServiceNode, err = os.Hostname(); err != nil {
+			return fmt.Errorf("could not find hostname for service node: %s", err)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, config); err != nil {
+		return err
+	}
+
+	if *format == "v1" && !json.Valid(buffer.Bytes()) {
+		return fmt.Errorf("generated v1 bootstrap is not valid JSON")
+	}
+
+	if *output == "" {
+		_, err = buffer.WriteTo(os.Stdout)
+		return err
+	}
+
+	return ioutil.WriteFile(*output, buffer.Bytes(), 0644)
+}
+
+// resolveDiscoveryAddress will return the address of a passing consul-envoy
+// instance from the Consul catalog. For v2, the port is the xDS gRPC port from
+// the "xds_port" service meta or the fallback port
+func resolveDiscoveryAddress(service, format string, xdsPort int) (string, int, error) {
+	consul, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return "", 0, err
+	}
+
+	entries, _, err := consul.Health().Service(service, "", true, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(entries) == 0 {
+		return "", 0, fmt.Errorf("no passing instances of service %s", service)
+	}
+
+	entry := entries[0]
+	host := entry.Service.Address
+	if host == "" {
+		host = entry.Node.Address
+	}
+
+	if format == "v1" {
+		return host, entry.Service.Port, nil
+	}
+
+	if value, ok := entry.Service.Meta["xds_port"]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid xds_port meta %q", value)
+		}
+		return host, port, nil
+	}
+
+	if xdsPort == 0 {
+		return "", 0, fmt.Errorf("service %s has no xds_port meta, use -xds-port", service)
+	}
+
+	return host, xdsPort, nil
+}
+
+// splitAddress will split a host:port address
+func splitAddress(address string) (string, int, error) {
+	host, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portValue)
+	}
+
+	return host, port, nil
+}
+
+// bootstrapV1 is the Envoy v1 JSON bootstrap, using CDS, SDS, RDS and LDS
+const bootstrapV1 = `{
+    "listeners": [
+{{- if not .LDS}}
+        {
+            "address": "tcp://0.0.0.0:{{.ListenerPort}}",
+            "filters": [
+                {
+                    "name": "http_connection_manager",
+                    "config": {
+                        "codec_type": "auto",
+                        "stat_prefix": "http",
+                        "use_remote_address": true,
+                        "rds": {
+                            "route_config_name": {{quote .RouteConfig}},
+                            "refresh_delay_ms": 10000,
+                            "cluster": "rds_http"
+                        },
+                        "filters": [
+                            {
+                                "name": "router",
+                                "config": {}
+                            }
+                        ]
+                    }
+                }
+            ]
+        }
+{{- end}}
+    ],
+{{- if .LDS}}
+    "lds": {
+        "cluster": "lds",
+        "refresh_delay_ms": 10000
+    },
+{{- end}}
+    "admin": {
+        "access_log_path": "/dev/null",
+        "address": "tcp://{{.AdminHost}}:{{.AdminPort}}"
+    },
+    "cluster_manager": {
+        "cds": {
+            "refresh_delay_ms": 10000,
+            "cluster": {
+                "name": "cds",
+                "type": "logical_dns",
+                "lb_type": "round_robin",
+                "connect_timeout_ms": 1000,
+                "hosts": [
+                    {
+                        "url": "tcp://{{.DiscoveryHost}}:{{.DiscoveryPort}}"
+                    }
+                ]
+            }
+        },
+        "sds": {
+            "refresh_delay_ms": 5000,
+            "cluster": {
+                "name": "sds",
+                "type": "logical_dns",
+                "lb_type": "round_robin",
+                "connect_timeout_ms": 1000,
+                "hosts": [
+                    {
+                        "url": "tcp://{{.DiscoveryHost}}:{{.DiscoveryPort}}"
+                    }
+                ]
+            }
+        },
+        "clusters": [
+{{- if .LDS}}
+            {
+                "name": "lds",
+                "type": "logical_dns",
+                "lb_type": "round_robin",
+                "connect_timeout_ms": 1000,
+                "hosts": [
+                    {
+                        "url": "tcp://{{.DiscoveryHost}}:{{.DiscoveryPort}}"
+                    }
+                ]
+            },
+{{- end}}
+            {
+                "name": "rds_http",
+                "type": "logical_dns",
+                "lb_type": "round_robin",
+                "connect_timeout_ms": 1000,
+                "hosts": [
+                    {
+                        "url": "tcp://{{.DiscoveryHost}}:{{.DiscoveryPort}}"
+                    }
+                ]
+            }
+        ]
+    }
+}
+`
+
+// bootstrapV2 is the Envoy v2 YAML bootstrap, using ADS over gRPC
+const bootstrapV2 = `node:
+  id: {{quote .ServiceNode}}
+{{- if .ServiceCluster}}
+  cluster: {{quote .ServiceCluster}}
+{{- end}}
+admin:
+  access_log_path: /dev/null
+  address:
+    socket_address:
+      address: {{quote .AdminHost}}
+      port_value: {{.AdminPort}}
+dynamic_resources:
+  ads_config:
+    api_type: {{if .Delta}}DELTA_GRPC{{else}}GRPC{{end}}
+    grpc_services:
+    - envoy_grpc:
+        cluster_name: xds
+  cds_config:
+    ads: {}
+{{- if .LDS}}
+  lds_config:
+    ads: {}
+{{- end}}
+static_resources:
+{{- if not .LDS}}
+  listeners:
+  - name: http
+    address:
+      socket_address:
+        address: 0.0.0.0
+        port_value: {{.ListenerPort}}
+    filter_chains:
+    - filters:
+      - name: envoy.http_connection_manager
+        config:
+          codec_type: AUTO
+          stat_prefix: http
+          use_remote_address: true
+          rds:
+            route_config_name: {{quote .RouteConfig}}
+            config_source:
+              ads: {}
+          http_filters:
+          - name: envoy.router
+{{- end}}
+  clusters:
+  - name: xds
+    type: STRICT_DNS
+    connect_timeout: 1s
+    http2_protocol_options: {}
+    hosts:
+    - socket_address:
+        address: {{quote .DiscoveryHost}}
+        port_value: {{.DiscoveryPort}}
+`
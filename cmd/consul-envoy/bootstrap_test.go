@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// update will rewrite the golden files with the rendered bootstraps
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestBootstrapTemplates(t *testing.T) {
+	tests := []struct {
+		golden string
+		format string
+		lds    bool
+		delta  bool
+	}{
+		{golden: "bootstrap-v1-lds.golden", format: "v1", lds: true},
+		{golden: "bootstrap-v1-static.golden", format: "v1", lds: false},
+		{golden: "bootstrap-v2-lds.golden", format: "v2", lds: true},
+		{golden: "bootstrap-v2-static.golden", format: "v2", lds: false},
+		{golden: "bootstrap-v2-delta.golden", format: "v2", lds: true, delta: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			config := bootstrapConfig{
+				DiscoveryHost:  "10.0.0.1",
+				DiscoveryPort:  8080,
+				AdminHost:      "127.0.0.1",
+				AdminPort:      9901,
+				LDS:            test.lds,
+				Delta:          test.delta,
+				ListenerPort:   80,
+				RouteConfig:    "default",
+				ServiceCluster: "web",
+				ServiceNode:    "web-1",
+			}
+
+			var buffer bytes.Buffer
+			if err := bootstrapTemplates[test.format].Execute(&buffer, config); err != nil {
+				t.Fatal(err)
+			}
+
+			switch test.format {
+			case "v1":
+				if !json.Valid(buffer.Bytes()) {
+					t.Fatalf("rendered bootstrap is not valid JSON:\n%s", buffer.String())
+				}
+
+			case "v2":
+				var parsed map[string]interface{}
+				if err := yaml.Unmarshal(buffer.Bytes(), &parsed); err != nil {
+					t.Fatalf("rendered bootstrap is not valid YAML: %s\n%s", err, buffer.String())
+				}
+
+				for _, key := range []string{"node", "admin", "dynamic_resources", "static_resources"} {
+					if _, ok := parsed[key]; !ok {
+						t.Errorf("rendered bootstrap is missing %q", key)
+					}
+				}
+			}
+
+			path := filepath.Join("testdata", test.golden)
+			if *update {
+				if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buffer.Bytes(), expected) {
+				t.Errorf("rendered bootstrap differs from %s (run with -update to accept):\n%s", path, buffer.String())
+			}
+		})
+	}
+}
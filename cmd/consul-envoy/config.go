@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/lds"
+	"github.com/jippi/consul-envoy/service/rds"
+	"github.com/jippi/consul-envoy/service/sds"
+	log "github.com/sirupsen/logrus"
+)
+
+// sdsConfigFromEnv will return the SDS configuration from the environment
+func sdsConfigFromEnv() sds.Config {
+	config := sds.Config{
+		HealthPolicy: sds.HealthPassing,
+		AZSources:    sds.DefaultAZSources,
+		CanaryTag:    os.Getenv("SDS_CANARY_TAG"),
+	}
+
+	if value := os.Getenv("SDS_HEALTH_POLICY"); value != "" {
+		policy, err := sds.ParseHealthPolicy(value)
+		if err != nil {
+			log.Fatalf("Invalid SDS_HEALTH_POLICY: %s", err)
+		}
+		config.HealthPolicy = policy
+	}
+
+	if value := os.Getenv("SDS_AZ_SOURCES"); value != "" {
+		sources, err := sds.ParseAZSources(value)
+		if err != nil {
+			log.Fatalf("Invalid SDS_AZ_SOURCES: %s", err)
+		}
+		config.AZSources = sources
+	}
+
+	if config.CanaryTag == "" {
+		config.CanaryTag = "canary"
+	}
+
+	if value := os.Getenv("SDS_FAILOVER"); value != "" {
+		policy, err := sds.ParseFailoverPolicy(value)
+		if err != nil {
+			log.Fatalf("Invalid SDS_FAILOVER: %s", err)
+		}
+		config.Failover = policy
+	}
+
+	if value := os.Getenv("SIDECAR_MODE"); value != "" {
+		mode, err := sds.ParseSidecarMode(value)
+		if err != nil {
+			log.Fatalf("Invalid SIDECAR_MODE: %s", err)
+		}
+		config.Sidecar = mode
+	}
+
+	return config
+}
+
+// rdsConfigFromEnv will return the RDS configuration from the environment,
+// loading the routing rules file
+func rdsConfigFromEnv() rds.Config {
+	config := rds.Config{RulesFile: os.Getenv("RDS_RULES_FILE")}
+	if config.RulesFile != "" {
+		rules, err := rds.LoadRules(config.RulesFile)
+		if err != nil {
+			log.Fatalf("Could not load RDS_RULES_FILE: %s", err)
+		}
+		config.Rules = rules
+	}
+
+	return config
+}
+
+// ldsConfigFromEnv will return the LDS configuration from the environment
+func ldsConfigFromEnv() lds.Config {
+	config := lds.Config{
+		ListenerAddress: os.Getenv("LDS_LISTENER_ADDRESS"),
+		ListenerPort:    80,
+		RDSCluster:      os.Getenv("LDS_RDS_CLUSTER"),
+	}
+
+	if config.ListenerAddress == "" {
+		config.ListenerAddress = "0.0.0.0"
+	}
+
+	if value := os.Getenv("LDS_LISTENER_PORT"); value != "" {
+		listenerPort, err := strconv.Atoi(value)
+		if err != nil || listenerPort <= 0 || listenerPort > 65535 {
+			log.Fatalf("Invalid LDS_LISTENER_PORT: %s", value)
+		}
+		config.ListenerPort = listenerPort
+	}
+
+	if config.RDSCluster == "" {
+		config.RDSCluster = "rds_http"
+	}
+
+	return config
+}
+
+// kvPrefixFromEnv will return the consul-envoy Consul KV prefix from the environment
+func kvPrefixFromEnv() string {
+	prefix := strings.Trim(os.Getenv("CONSUL_KV_PREFIX"), "/")
+	if prefix == "" {
+		return "consul-envoy"
+	}
+
+	return prefix
+}
@@ -3,25 +3,59 @@ package main
 import (
 	"encoding/json"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/catalog"
 	"github.com/jippi/consul-envoy/service/cds"
+	"github.com/jippi/consul-envoy/service/lds"
+	"github.com/jippi/consul-envoy/service/policy"
 	"github.com/jippi/consul-envoy/service/rds"
 	"github.com/jippi/consul-envoy/service/sds"
+	"github.com/jippi/consul-envoy/service/xds"
 	log "github.com/sirupsen/logrus"
 )
 
 // https://github.com/lyft/discovery
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bootstrap":
+			if err := bootstrap(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+
+		case "render":
+			if err := render(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+
+		case "route-test":
+			if err := routeTestCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("missing PORT to listen on")
 	}
 
+	sdsConfig := sdsConfigFromEnv()
+	rdsConfig := rdsConfigFromEnv()
+	ldsConfig := ldsConfigFromEnv()
+	kvPrefix := kvPrefixFromEnv()
+	xdsPort := os.Getenv("XDS_PORT")
+
 	consul, err := api.NewClient(api.DefaultConfig())
 	if err != nil {
 		log.Fatalf("Could not create consul client: %s", err)
@@ -37,34 +71,103 @@ func main() {
 		log.Fatal("Could not find consul domain")
 	}
 
-	cdsCh := make(chan map[string][]string, 10)
-	rdsCh := make(chan map[string][]string, 10)
-	sdsCh := make(chan map[string][]string, 10)
-	go servicesReader(consul, cdsCh, rdsCh, sdsCh)
+	localDatacenter, ok := node["Config"]["Datacenter"].(string)
+	if !ok {
+		log.Fatal("Could not find consul datacenter")
+	}
+
+	datacenters := []string{localDatacenter}
+	for _, dc := range strings.Split(os.Getenv("CONSUL_DATACENTERS"), ",") {
+		if dc = strings.TrimSpace(dc); dc != "" && dc != localDatacenter {
+			datacenters = append(datacenters, dc)
+		}
+	}
+
+	queries := make([]string, 0)
+	for _, query := range strings.Split(os.Getenv("CONSUL_PREPARED_QUERIES"), ",") {
+		if query = strings.TrimSpace(query); query != "" {
+			queries = append(queries, query)
+		}
+	}
 
-	cdsWorker := cds.NewWorker(consul, cdsCh)
+	cdsCh := make(chan catalog.Services, 10)
+	rdsCh := make(chan catalog.Services, 10)
+	sdsCh := make(chan catalog.Services, 10)
+	ldsCh := make(chan catalog.Services, 10)
+	policyCh := make(chan catalog.Services, 10)
+	go servicesReader(consul, localDatacenter, datacenters, queries, cdsCh, rdsCh, sdsCh, ldsCh, policyCh)
+
+	cdsKVCh := make(chan map[string][]byte, 10)
+	rdsKVCh := make(chan map[string][]byte, 10)
+	ldsKVCh := make(chan map[string][]byte, 10)
+	policyKVCh := make(chan map[string][]byte, 10)
+	go kvReader(consul, kvPrefix, cdsKVCh, rdsKVCh, ldsKVCh, policyKVCh)
+
+	cdsWorker := cds.NewWorker(consul, cdsCh, cdsKVCh)
 	go cdsWorker.Start()
 
-	rdsWorker := rds.NewWorker(consul, consulDomain, rdsCh)
+	rdsWorker := rds.NewWorker(consul, consulDomain, rdsCh, rdsKVCh, rdsConfig)
 	go rdsWorker.Start()
 
-	sdsWorker := sds.NewWorker(consul, sdsCh)
+	sdsWorker := sds.NewWorker(consul, sdsCh, sdsConfig)
 	go sdsWorker.Start()
 
+	ldsWorker := lds.NewWorker(ldsCh, ldsKVCh, ldsConfig)
+	go ldsWorker.Start()
+
+	policyWorker := policy.NewWorker(policyCh, policyKVCh)
+	go policyWorker.Start()
+
+	xdsWorker := xds.NewWorker(cdsWorker, rdsWorker, sdsWorker, ldsWorker, policyWorker)
+	go xdsWorker.Start()
+
+	// xDS - v2 gRPC management server (ADS, CDS, EDS, RDS and LDS)
+	if xdsPort != "" {
+		listener, err := net.Listen("tcp", "0.0.0.0:"+xdsPort)
+		if err != nil {
+			log.Fatalf("Could not listen on XDS_PORT: %s", err)
+		}
+
+		go func() {
+			if err := xdsWorker.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	router := mux.NewRouter()
 
 	// CDS - Cluster discovery service - https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/cluster_manager/cds#config-cluster-manager-cds-v1
 	router.HandleFunc("/v1/clusters/{service_cluster}/{service_node}", func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
 		log.Infof("/v1/clusters/%s/%s", params["service_cluster"], params["service_node"])
-		json.NewEncoder(w).Encode(cdsWorker.Response())
+		scope := policyWorker.Policy(params["service_cluster"])
+		response := cdsWorker.Response().Scoped(scope.Allows)
+
+		// In sidecar mode, SDS requests must include the Envoy node to prefer
+		// the instances on the node
+		if sdsConfig.Sidecar.Enabled() {
+			node := params["service_node"]
+			inbound := sdsWorker.NodeHosts(params["service_cluster"], node)
+			response = response.Sidecar(params["service_cluster"], inbound, func(cluster string) string {
+				return sds.SidecarServiceName(cluster, node)
+			})
+		}
+
+		json.NewEncoder(w).Encode(response)
 	})
 
 	// RDS - Route discovery service - https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/route_config/rds#config-http-conn-man-rds-v1
 	router.HandleFunc("/v1/routes/{route_config_name}/{service_cluster}/{service_node}", func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
 		log.Infof("/v1/routes/%s/%s/%s", params["route_config_name"], params["service_cluster"], params["service_node"])
-		json.NewEncoder(w).Encode(rdsWorker.Response())
+		payload, ok := rdsWorker.Response(params["route_config_name"])
+		if !ok {
+			http.Error(w, "Unknown route_config_name: "+params["route_config_name"], http.StatusNotFound)
+			return
+		}
+		scope := policyWorker.Policy(params["service_cluster"])
+		json.NewEncoder(w).Encode(payload.Scoped(scope.Allows))
 	})
 
 	// SDS - Service discovery service - https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/cluster_manager/sds#config-cluster-manager-sds-api
@@ -79,23 +182,157 @@ func main() {
 		json.NewEncoder(w).Encode(payload)
 	})
 
+	// LDS - Listener discovery service - https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/listeners/lds#config-listeners-lds-v1
+	router.HandleFunc("/v1/listeners/{service_cluster}/{service_node}", func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		log.Infof("/v1/listeners/%s/%s", params["service_cluster"], params["service_node"])
+		scope := policyWorker.Policy(params["service_cluster"])
+		json.NewEncoder(w).Encode(ldsWorker.Response().Scoped(scope.Allows))
+	})
+
+	// Route test - which route and cluster serve a request
+	router.HandleFunc("/debug/route-test", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		routeConfig := query.Get("route_config")
+		if routeConfig == "" {
+			routeConfig = rds.DefaultRouteTable
+		}
+
+		payload, ok := rdsWorker.Response(routeConfig)
+		if !ok {
+			http.Error(w, "Unknown route_config: "+routeConfig, http.StatusNotFound)
+			return
+		}
+
+		if serviceCluster := query.Get("service_cluster"); serviceCluster != "" {
+			payload = payload.Scoped(policyWorker.Policy(serviceCluster).Allows)
+		}
+
+		request := rds.Request{
+			Host:    query.Get("host"),
+			Path:    query.Get("path"),
+			Method:  query.Get("method"),
+			Headers: make(map[string]string),
+		}
+		if request.Path == "" {
+			request.Path = "/"
+		}
+		if request.Method == "" {
+			request.Method = "GET"
+		}
+		for _, header := range query["header"] {
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) != 2 {
+				http.Error(w, "Invalid header, must be Name:value: "+header, http.StatusBadRequest)
+				return
+			}
+			request.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+
+		json.NewEncoder(w).Encode(payload.Match(request))
+	}).Methods("GET")
+
+	// xDS v2 REST-JSON - https://www.envoyproxy.io/docs/envoy/v1.9.0/api-docs/xds_protocol#rest-json-polling-subscriptions
+	for _, resource := range []string{"clusters", "endpoints", "routes", "listeners"} {
+		router.HandleFunc("/v2/discovery:"+resource, xdsWorker.RESTHandler(resource)).Methods("POST")
+	}
+
 	// Listen on HTTP
 	if err := http.ListenAndServe("0.0.0.0:"+port, router); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func servicesReader(client *api.Client, cdsCh, rdsCh, sdsCh chan map[string][]string) {
+// datacenterServices are the services (with tags) of a single datacenter
+type datacenterServices struct {
+	datacenter string
+	services   map[string][]string
+}
+
+// servicesReader will watch the services in all datacenters and send the
+// combined services, together with their subsets and the prepared queries, to
+// the workers
+func servicesReader(client *api.Client, localDatacenter string, datacenters, queries []string, outputs ...chan catalog.Services) {
+	updateCh := make(chan datacenterServices, len(datacenters))
+	for _, dc := range datacenters {
+		go datacenterReader(client, dc, updateCh)
+	}
+
+	current := make(map[string]map[string][]string)
+
+	for update := range updateCh {
+		current[update.datacenter] = update.services
+
+		services := make(catalog.Services)
+		for dc, dcServices := range current {
+			for name, tags := range dcServices {
+				service := catalog.Service{
+					Name:       name,
+					Datacenter: dc,
+					Tags:       tags,
+					Local:      dc == localDatacenter,
+				}
+				services[service.ClusterName()] = service
+			}
+		}
+
+		for _, name := range queries {
+			query := catalog.Service{
+				Name:       name,
+				Datacenter: localDatacenter,
+				Local:      true,
+				Query:      true,
+			}
+			services[query.ClusterName()] = query
+		}
+
+		services = services.WithSubsets(datacenters)
+
+		for _, output := range outputs {
+			output <- services
+		}
+	}
+}
+
+// datacenterReader will watch the services in a single datacenter
+func datacenterReader(client *api.Client, datacenter string, updateCh chan datacenterServices) {
 	query := &api.QueryOptions{
 		AllowStale: true,
+		Datacenter: datacenter,
 		WaitIndex:  0,
 		WaitTime:   5 * time.Minute,
 	}
 
+	logger := log.WithField("datacenter", datacenter)
+
 	for {
-		log.Info("Reading services")
+		logger.Info("Reading services")
 		services, meta, err := client.Catalog().Services(query)
-		log.Info("Read services")
+		logger.Info("Read services")
+		if err != nil {
+			logger.Error(err)
+			time.Sleep(jitter(5 * time.Second))
+			continue
+		}
+
+		query.WaitIndex = meta.LastIndex
+		updateCh <- datacenterServices{datacenter: datacenter, services: services}
+	}
+}
+
+// kvReader will watch the consul-envoy KV prefix and send all documents, keyed
+// by their path relative to the prefix, to the workers
+func kvReader(client *api.Client, prefix string, outputs ...chan map[string][]byte) {
+	query := &api.QueryOptions{
+		AllowStale: true,
+		WaitIndex:  0,
+		WaitTime:   5 * time.Minute,
+	}
+
+	for {
+		log.Info("Reading KV documents")
+		pairs, meta, err := client.KV().List(prefix+"/", query)
+		log.Info("Read KV documents")
 		if err != nil {
 			log.Error(err)
 			time.Sleep(jitter(5 * time.Second))
@@ -103,9 +340,15 @@ func servicesReader(client *api.Client, cdsCh, rdsCh, sdsCh chan map[string][]st
 		}
 
 		query.WaitIndex = meta.LastIndex
-		cdsCh <- services
-		rdsCh <- services
-		sdsCh <- services
+
+		documents := make(map[string][]byte)
+		for _, pair := range pairs {
+			documents[strings.TrimPrefix(pair.Key, prefix+"/")] = pair.Value
+		}
+
+		for _, output := range outputs {
+			output <- documents
+		}
 	}
 }
 
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/cds"
+	"github.com/jippi/consul-envoy/service/lds"
+	"github.com/jippi/consul-envoy/service/rds"
+	"github.com/jippi/consul-envoy/service/sds"
+	"github.com/jippi/consul-envoy/service/tags"
+)
+
+// catalogDump is a dump of the Consul catalog of a single datacenter
+type catalogDump struct {
+	Datacenter string                         `json:"datacenter"` // Consul datacenter (default: dc1)
+	Domain     string                         `json:"domain"`     // Consul DNS domain (default: consul)
+	Services   map[string][]*api.ServiceEntry `json:"services"`   // Instances of each service, as returned by /v1/health/service/<service>
+}
+
+// kvExport is a Consul KV pair, in the "consul kv export" format
+type kvExport struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"` // Base64 encoded
+}
+
+// renderOutput is the CDS, RDS, SDS and LDS responses rendered from a dump
+type renderOutput struct {
+	Clusters      cds.Response            `json:"clusters"`
+	Routes        map[string]rds.Response `json:"routes"`        // RDS responses, keyed by route table
+	Registrations map[string]sds.Response `json:"registrations"` // SDS responses, keyed by cluster
+	Listeners     lds.Response            `json:"listeners"`
+}
+
+// render will print the CDS, RDS, SDS and LDS responses the workers would
+// build from a dump of the Consul catalog and KV
+func render(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	catalogFile := flags.String("catalog", "", "JSON dump of the Consul catalog (required)")
+	kvFile := flags.String("kv", "", "Consul KV dump, in the \"consul kv export\" format")
+	rulesFile := flags.String("rules", os.Getenv("RDS_RULES_FILE"), "routing rules file")
+	output := flags.String("output", "", "file to write the responses to, defaults to stdout")
+	flags.Parse(args)
+
+	if *catalogFile == "" {
+		return fmt.Errorf("missing -catalog")
+	}
+
+	dump, err := readCatalogDump(*catalogFile)
+	if err != nil {
+		return err
+	}
+
+	kv := make(map[string][]byte)
+	if *kvFile != "" {
+		if kv, err = readKVExport(*kvFile, kvPrefixFromEnv()); err != nil {
+			return err
+		}
+	}
+
+	var rules *rds.Rules
+	if *rulesFile != "" {
+		if rules, err = rds.LoadRules(*rulesFile); err != nil {
+			return err
+		}
+	}
+
+	services := make(catalog.Services)
+	metas := make(map[string]map[string]string)
+	for name, entries := range dump.Services {
+		service := catalog.Service{
+			Name:       name,
+			Datacenter: dump.Datacenter,
+			Tags:       serviceTags(entries),
+			Local:      true,
+		}
+		services[service.ClusterName()] = service
+	}
+	services = services.WithSubsets([]string{dump.Datacenter})
+
+	for name, service := range services {
+		if entries := subsetEntries(dump.Services[service.Name], service.Subset); len(entries) > 0 {
+			metas[name] = entries[0].Service.Meta
+		}
+	}
+
+	sdsConfig := sdsConfigFromEnv()
+	result := renderOutput{
+		Clusters:      cds.Build(services, metas, kv),
+		Routes:        rds.Build(services, dump.Domain, rules, kv),
+		Registrations: make(map[string]sds.Response),
+		Listeners:     lds.Build(ldsConfigFromEnv(), services, kv),
+	}
+
+	for name, service := range services {
+		result.Registrations[name] = sds.Build(subsetEntries(dump.Services[service.Name], service.Subset), service.Tags, sdsConfig)
+	}
+
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	return ioutil.WriteFile(*output, data, 0644)
+}
+
+// readCatalogDump will read a JSON dump of the Consul catalog
+func readCatalogDump(path string) (*catalogDump, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &catalogDump{}
+	if err := json.Unmarshal(data, dump); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	if dump.Datacenter == "" {
+		dump.Datacenter = "dc1"
+	}
+
+	if dump.Domain == "" {
+		dump.Domain = "consul"
+	}
+
+	return dump, nil
+}
+
+// readKVExport will read a "consul kv export" dump, returning the documents
+// below the prefix keyed by their path relative to the prefix, like the KV reader
+func readKVExport(path, prefix string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]kvExport, 0)
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	documents := make(map[string][]byte)
+	for _, pair := range pairs {
+		if strings.HasPrefix(pair.Key, prefix+"/") {
+			documents[strings.TrimPrefix(pair.Key, prefix+"/")] = pair.Value
+		}
+	}
+
+	return documents, nil
+}
+
+// serviceTags will return the tags of all instances of a service, like the
+// Consul catalog services endpoint
+func serviceTags(entries []*api.ServiceEntry) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+
+	for _, entry := range entries {
+		for _, tag := range entry.Service.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				result = append(result, tag)
+			}
+		}
+	}
+
+	return result
+}
+
+// subsetEntries will return the instances with the subset tag, like the
+// Consul tag filter, or all instances without a subset
+func subsetEntries(entries []*api.ServiceEntry, subset string) []*api.ServiceEntry {
+	if subset == "" {
+		return entries
+	}
+
+	result := make([]*api.ServiceEntry, 0)
+	for _, entry := range entries {
+		if tags.Has(entry.Service.Tags, subset) {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
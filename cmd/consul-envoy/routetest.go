@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/rds"
+)
+
+// headerFlags are repeated -header "Name: value" flags
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("header %q must be \"Name: value\"", value)
+	}
+
+	h[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// routeTest is a request and the expected match, in a route test file
+type routeTest struct {
+	Name        string           `json:"name,omitempty"`
+	RouteConfig string           `json:"route_config,omitempty"` // Route table (default: the -route-config flag)
+	Request     rds.Request      `json:"request"`
+	Expect      routeExpectation `json:"expect"`
+}
+
+// routeExpectation is the expected match of a route test, empty fields are not checked
+type routeExpectation struct {
+	NoMatch          bool           `json:"no_match,omitempty"` // Expect no route to match
+	VirtualHost      string         `json:"virtual_host,omitempty"`
+	Cluster          string         `json:"cluster,omitempty"`
+	WeightedClusters map[string]int `json:"weighted_clusters,omitempty"` // Weight of each cluster
+	Redirect         string         `json:"redirect,omitempty"`
+	Path             string         `json:"path,omitempty"`
+	PrefixRewrite    string         `json:"prefix_rewrite,omitempty"`
+	HostRewrite      string         `json:"host_rewrite,omitempty"`
+}
+
+// routeTestCommand will report which route and cluster serve a request, or run a
+// file of route tests against the route tables
+func routeTestCommand(args []string) error {
+	flags := flag.NewFlagSet("route-test", flag.ExitOnError)
+	server := flags.String("server", "http://127.0.0.1:"+os.Getenv("PORT"), "consul-envoy address to read the route tables from")
+	routesFile := flags.String("routes", "", "RDS response to read the route table from, instead of -server")
+	routeConfig := flags.String("route-config", rds.DefaultRouteTable, "route table to match against")
+	serviceCluster := flags.String("service-cluster", "route-test", "Envoy service cluster, scoping the routes by its policy")
+	host := flags.String("host", "", "host (authority) of the request")
+	path := flags.String("path", "/", "path of the request")
+	method := flags.String("method", "GET", "method of the request")
+	testFile := flags.String("file", "", "JSON file of route tests, instead of a single request")
+	headers := make(headerFlags)
+	flags.Var(headers, "header", "header of the request as \"Name: value\", may be repeated")
+	flags.Parse(args)
+
+	tables := make(map[string]rds.Response)
+	routeTable := func(name string) (rds.Response, error) {
+		if response, ok := tables[name]; ok {
+			return response, nil
+		}
+
+		var response rds.Response
+		var err error
+		if *routesFile != "" {
+			response, err = readRoutes(*routesFile)
+		} else {
+			response, err = fetchRoutes(*server, name, *serviceCluster)
+		}
+		if err != nil {
+			return response, err
+		}
+
+		tables[name] = response
+		return response, nil
+	}
+
+	if *testFile == "" {
+		if *host == "" {
+			return fmt.Errorf("missing -host")
+		}
+
+		response, err := routeTable(*routeConfig)
+		if err != nil {
+			return err
+		}
+
+		request := rds.Request{Host: *host, Path: *path, Method: *method, Headers: headers}
+		data, err := json.MarshalIndent(response.Match(request), "", "    ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(data))
+		return nil
+	}
+
+	tests, err := readRouteTests(*testFile)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, test := range tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i)
+		}
+
+		table := test.RouteConfig
+		if table == "" {
+			table = *routeConfig
+		}
+
+		response, err := routeTable(table)
+		if err != nil {
+			return err
+		}
+
+		if test.Request.Method == "" {
+			test.Request.Method = "GET"
+		}
+		if test.Request.Path == "" {
+			test.Request.Path = "/"
+		}
+
+		problems := test.Expect.check(response.Match(test.Request))
+		if len(problems) == 0 {
+			fmt.Printf("PASS %s\n", name)
+			continue
+		}
+
+		failed++
+		fmt.Printf("FAIL %s: %s\n", name, strings.Join(problems, ", "))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d route tests failed", failed, len(tests))
+	}
+
+	return nil
+}
+
+// check will return the differences between the match and the expectation
+func (e routeExpectation) check(match rds.Match) []string {
+	if e.NoMatch {
+		if match.Matched() {
+			return []string{fmt.Sprintf("expected no match, got cluster %q", match.Cluster)}
+		}
+		return nil
+	}
+
+	if !match.Matched() {
+		return []string{"no route matched"}
+	}
+
+	problems := make([]string, 0)
+	for _, field := range []struct{ name, expected, actual string }{
+		{"virtual_host", e.VirtualHost, match.VirtualHost},
+		{"cluster", e.Cluster, match.Cluster},
+		{"redirect", e.Redirect, match.Redirect},
+		{"path", e.Path, match.Path},
+		{"prefix_rewrite", e.PrefixRewrite, match.PrefixRewrite},
+		{"host_rewrite", e.HostRewrite, match.HostRewrite},
+	} {
+		if field.expected != "" && field.expected != field.actual {
+			problems = append(problems, fmt.Sprintf("%s is %q, expected %q", field.name, field.actual, field.expected))
+		}
+	}
+
+	if e.WeightedClusters != nil {
+		weights := make(map[string]int)
+		if match.WeightedClusters != nil {
+			for _, cluster := range match.WeightedClusters.Clusters {
+				weights[cluster.Name] = cluster.Weight
+			}
+		}
+
+		if !reflect.DeepEqual(weights, e.WeightedClusters) {
+			problems = append(problems, fmt.Sprintf("weighted_clusters are %v, expected %v", weights, e.WeightedClusters))
+		}
+	}
+
+	return problems
+}
+
+// fetchRoutes will read a route table from the RDS endpoint of consul-envoy
+func fetchRoutes(server, routeConfig, serviceCluster string) (rds.Response, error) {
+	var response rds.Response
+
+	url := fmt.Sprintf("%s/v1/routes/%s/%s/route-test", strings.TrimSuffix(server, "/"), routeConfig, serviceCluster)
+	res, err := http.Get(url)
+	if err != nil {
+		return response, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return response, fmt.Errorf("could not read route table %s: %s", routeConfig, res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return response, fmt.Errorf("could not parse route table %s: %s", routeConfig, err)
+	}
+
+	return response, nil
+}
+
+// readRoutes will read a route table from a RDS response file
+func readRoutes(path string) (rds.Response, error) {
+	var response rds.Response
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return response, err
+	}
+
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	return response, nil
+}
+
+// readRouteTests will read a JSON file of route tests
+func readRouteTests(path string) ([]routeTest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tests := make([]routeTest, 0)
+	if err := json.Unmarshal(data, &tests); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	return tests, nil
+}
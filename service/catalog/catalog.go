@@ -0,0 +1,37 @@
+package catalog
+
+// Service is a Consul service in a specific datacenter, or a Consul prepared query
+type Service struct {
+	Name       string   // Consul service name, or prepared query name
+	Datacenter string   // Consul datacenter the service is registered in
+	Tags       []string // Consul service tags
+	Local      bool     // True if the datacenter is the local datacenter
+	Query      bool     // True if the service is a prepared query
+	Subset     string   // Service tag the instances must have, for subsets of a service
+}
+
+// Services is a set of Consul services, keyed by their Envoy cluster name
+type Services map[string]Service
+
+// ClusterName will return the Envoy cluster name for the service.
+//
+// Services in the local datacenter use the service name, while services in
+// remote datacenters are suffixed with the datacenter (e.g. "api.dc2") and
+// prepared queries are suffixed with "query" (e.g. "api-failover.query").
+// Subsets are suffixed with the subset tag (e.g. "api.v2" or "api.v2.dc2")
+func (s Service) ClusterName() string {
+	if s.Query {
+		return s.Name + ".query"
+	}
+
+	name := s.Name
+	if s.Subset != "" {
+		name += "." + s.Subset
+	}
+
+	if s.Local {
+		return name
+	}
+
+	return name + "." + s.Datacenter
+}
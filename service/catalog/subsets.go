@@ -0,0 +1,76 @@
+package catalog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/tags"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithSubsets will return the services together with a subset service for
+// each tag listed in the "envoy.subsets" tag of a service (e.g.
+// "envoy.subsets=v1,v2"), only containing the instances with the tag.
+//
+// Subset tags that would make the cluster name of the subset ambiguous are
+// skipped with a warning, see validateSubset
+func (s Services) WithSubsets(datacenters []string) Services {
+	result := make(Services, len(s))
+
+	for name, service := range s {
+		result[name] = service
+
+		if service.Query || service.Subset != "" {
+			continue
+		}
+
+		value, ok := tags.Lookup(service.Tags, nil, "subsets")
+		if !ok {
+			continue
+		}
+
+		for _, subset := range strings.Split(value, ",") {
+			if subset = strings.TrimSpace(subset); subset == "" {
+				continue
+			}
+
+			subsetService := service
+			subsetService.Subset = subset
+
+			if err := validateSubset(subsetService, s, datacenters); err != nil {
+				log.WithField("service", name).Warnf("Skipping subset: %s", err)
+				continue
+			}
+
+			result[subsetService.ClusterName()] = subsetService
+		}
+	}
+
+	return result
+}
+
+// validateSubset will check that the cluster name of the subset can not be
+// mistaken for another cluster: the subset tag can not contain "." or be a
+// datacenter (e.g. subset "dc2" of the local "api" and "api" in dc2) or
+// "query" (e.g. subset "query" of "foo" and the prepared query "foo")
+func validateSubset(subset Service, services Services, datacenters []string) error {
+	if strings.Contains(subset.Subset, ".") {
+		return fmt.Errorf("subset %q can not contain \".\"", subset.Subset)
+	}
+
+	if subset.Subset == "query" {
+		return fmt.Errorf("subset %q is reserved for prepared queries", subset.Subset)
+	}
+
+	for _, dc := range datacenters {
+		if subset.Subset == dc {
+			return fmt.Errorf("subset %q is the name of a datacenter", subset.Subset)
+		}
+	}
+
+	if _, ok := services[subset.ClusterName()]; ok {
+		return fmt.Errorf("subset %q has the cluster name of another service", subset.Subset)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package catalog
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWithSubsets(t *testing.T) {
+	services := Services{
+		"api":    {Name: "api", Local: true, Tags: []string{"envoy.subsets=v1, v2,dc2,query,v3.1"}},
+		"api.v2": {Name: "api.v2", Local: true, Tags: []string{"legacy"}},
+		"web":    {Name: "web", Local: true},
+	}
+
+	result := services.WithSubsets([]string{"dc1", "dc2"})
+
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Only v1 is a valid subset: v2 collides with the api.v2 service, dc2 is a
+	// datacenter, query is reserved and v3.1 contains a "."
+	expected := []string{"api", "api.v1", "api.v2", "web"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected clusters %v, got %v", expected, names)
+	}
+
+	if subset := result["api.v1"]; subset.Name != "api" || subset.Subset != "v1" {
+		t.Errorf("expected api.v1 to be the v1 subset of api, got %+v", subset)
+	}
+
+	// The colliding service is kept as it was
+	if !reflect.DeepEqual(result["api.v2"], services["api.v2"]) {
+		t.Errorf("expected the api.v2 service to be kept, got %+v", result["api.v2"])
+	}
+}
@@ -0,0 +1,74 @@
+package cds
+
+import (
+	"fmt"
+
+	"github.com/jippi/consul-envoy/service/kvdoc"
+)
+
+// kvPrefix is the Consul KV path (relative to the consul-envoy KV prefix)
+// holding cluster override documents, one per service
+const kvPrefix = "clusters/"
+
+// validLBTypes are the load balancer types supported by Envoy
+var validLBTypes = map[string]bool{
+	"round_robin":     true,
+	"least_request":   true,
+	"random":          true,
+	"ring_hash":       true,
+	"original_dst_lb": true,
+}
+
+// validDocuments will return the cluster override documents from Consul KV,
+// keyed by service name. Invalid documents are logged and the previous valid
+// document for the service is kept
+func validDocuments(documents map[string][]byte, previous map[string][]byte) map[string][]byte {
+	return kvdoc.Parse(documents, previous, kvPrefix, "cluster", func(service string, document []byte) error {
+		_, err := applyDocument(Cluster{Name: service, ServiceName: service, Type: "sds", LBtype: "least_request"}, document)
+		return err
+	})
+}
+
+// applyDocument will overlay a JSON cluster document on top of the generated cluster
+func applyDocument(cluster Cluster, document []byte) (Cluster, error) {
+	name := cluster.Name
+
+	if err := kvdoc.Decode(document, &cluster); err != nil {
+		return cluster, err
+	}
+
+	if cluster.Name != name {
+		return cluster, fmt.Errorf("name can not be changed")
+	}
+
+	if err := validateCluster(cluster); err != nil {
+		return cluster, err
+	}
+
+	return cluster, nil
+}
+
+// validateCluster will check that the cluster can be accepted by Envoy
+func validateCluster(cluster Cluster) error {
+	if cluster.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+
+	if cluster.Type != "sds" {
+		return fmt.Errorf("type %q is not supported, must be sds", cluster.Type)
+	}
+
+	if !validLBTypes[cluster.LBtype] {
+		return fmt.Errorf("invalid lb_type %q", cluster.LBtype)
+	}
+
+	if cluster.ConnectTimeoutMS < 0 {
+		return fmt.Errorf("connect_timeout_ms must be positive")
+	}
+
+	if cluster.MaxRequestsPerConnection < 0 {
+		return fmt.Errorf("max_requests_per_connection must be positive")
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+package cds
+
+// Scoped will return the response with only the clusters allowed by the filter
+func (r Response) Scoped(allows func(cluster string) bool) Response {
+	clusters := make([]Cluster, 0, len(r.Clusters))
+	for _, cluster := range r.Clusters {
+		if allows(cluster.Name) {
+			clusters = append(clusters, cluster)
+		}
+	}
+
+	return Response{Clusters: clusters}
+}
@@ -0,0 +1,44 @@
+package cds
+
+import "fmt"
+
+// InboundPrefix is the prefix of the inbound cluster generated for the
+// service registered on the node of a sidecar Envoy
+const InboundPrefix = "inbound|"
+
+// Sidecar will return the response for a sidecar Envoy: clusters get a SDS
+// service name built by serviceName (e.g. including the Envoy node), and a
+// static inbound cluster is added for the local instances of the service
+func (r Response) Sidecar(service string, inbound []Host, serviceName func(cluster string) string) Response {
+	clusters := make([]Cluster, 0, len(r.Clusters)+1)
+	for _, cluster := range r.Clusters {
+		if cluster.Type == "sds" {
+			cluster.ServiceName = serviceName(cluster.ServiceName)
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	if len(inbound) > 0 {
+		clusters = append(clusters, InboundCluster(service, inbound))
+	}
+
+	return Response{Clusters: clusters}
+}
+
+// InboundCluster will return a static cluster for the instances of a service
+// on the node of a sidecar Envoy
+func InboundCluster(service string, hosts []Host) Cluster {
+	cluster := Cluster{
+		Name:             InboundPrefix + service,
+		Type:             "static",
+		LBtype:           "round_robin",
+		ConnectTimeoutMS: defaultConnectTimeout,
+		Hosts:            make([]URLHost, 0, len(hosts)),
+	}
+
+	for _, host := range hosts {
+		cluster.Hosts = append(cluster.Hosts, URLHost{URL: fmt.Sprintf("tcp://%s:%d", host.IP, host.Port)})
+	}
+
+	return cluster
+}
@@ -1,6 +1,6 @@
 package cds
 
-import "time"
+import "github.com/jippi/consul-envoy/service/millis"
 
 // Response ...
 // https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/cluster_manager/cds#config-cluster-manager-cds-v1
@@ -13,15 +13,15 @@ type Response struct {
 type Cluster struct {
 	Name                          string            `json:"name"`
 	Type                          string            `json:"type"`
-	ConnectTimeoutMS              time.Duration     `json:"connect_timeout_ms,omitempty"`
+	ConnectTimeoutMS              millis.Duration   `json:"connect_timeout_ms,omitempty"`
 	PerConnectionBufferLimitBytes int               `json:"per_connection_buffer_limit_bytes,omitempty"`
 	LBtype                        string            `json:"lb_type"`
-	Hosts                         []Host            `json:"hosts,omitempty"`
-	ServiceName                   string            `json:"service_name"`
+	Hosts                         []URLHost         `json:"hosts,omitempty"`
+	ServiceName                   string            `json:"service_name,omitempty"`
 	HealthCheck                   *HealthCheck      `json:"health_check,omitempty"`
 	MaxRequestsPerConnection      int               `json:"max_requests_per_connection,omitempty"`
-	CleanupIntervalMS             time.Duration     `json:"cleanup_interval_ms,omitempty"`
-	DNSRefreshRateMS              time.Duration     `json:"dns_refresh_rate_ms,omitempty"`
+	CleanupIntervalMS             millis.Duration   `json:"cleanup_interval_ms,omitempty"`
+	DNSRefreshRateMS              millis.Duration   `json:"dns_refresh_rate_ms,omitempty"`
 	OutlierDetection              *OutlierDetection `json:"outlier_detection,omitempty"`
 	// ring_hash_lb_config
 	// circuit_breakers
@@ -38,6 +38,16 @@ type Host struct {
 	IP   string    `json:"ip_address"`
 	Port int       `json:"port"`
 	Tags *HostTags `json:"tags,omitempty"`
+	Node string    `json:"-"` // Consul node of the instance, for sidecar mode
+
+	// Remote datacenter of a failover host, empty for local hosts
+	Datacenter string `json:"-"`
+}
+
+// URLHost is a host of a static or DNS cluster
+// https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/cluster_manager/cluster#config-cluster-manager-cluster-hosts
+type URLHost struct {
+	URL string `json:"url"`
 }
 
 // HostTags ...
@@ -52,12 +62,12 @@ type HostTags struct {
 // https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/cluster_manager/cluster_hc#config-cluster-manager-cluster-hc-v1
 type HealthCheck struct {
 	Type               string              `json:"type"`
-	TimeoutMS          time.Duration       `json:"timeout_ms"`
-	IntervalMS         time.Duration       `json:"interval_ms"`
+	TimeoutMS          millis.Duration     `json:"timeout_ms"`
+	IntervalMS         millis.Duration     `json:"interval_ms"`
 	UnhealthyThreshold int                 `json:"unhealthy_threshold"`
 	HealthyThreshold   int                 `json:"healthy_threshold"`
 	Path               string              `json:"path,omitempty"`
-	IntervalJitterMS   time.Duration       `json:"interval_jitter_ms,omitempty"`
+	IntervalJitterMS   millis.Duration     `json:"interval_jitter_ms,omitempty"`
 	ServiceName        string              `json:"service_name,omitempty"`
 	Send               []map[string]string `json:"send"`
 	Receive            []map[string]string `json:"receive"`
@@ -67,15 +77,15 @@ type HealthCheck struct {
 // OutlierDetection ...
 // https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/cluster_manager/cluster_outlier_detection#config-cluster-manager-cluster-outlier-detection
 type OutlierDetection struct {
-	Consecutive5xx                     int           `json:"consecutive_5xx,omitempty"`
-	ConsecutiveGatewayFailure          int           `json:"consecutive_gateway_failure,omitempty"`
-	IntervalMS                         time.Duration `json:"interval_ms,omitempty"`
-	BaseJjectionTimeMS                 time.Duration `json:"base_ejection_time_ms,omitempty"`
-	MaxEjectionPercent                 int           `json:"max_ejection_percent,omitempty"`
-	EnforcingConsecutive5xx            int           `json:"enforcing_consecutive_5xx,omitempty"`
-	EnforcingConsecutiveGatewayFailure int           `json:"enforcing_consecutive_gateway_failure,omitempty"`
-	EnforcingSuccessRate               int           `json:"enforcing_success_rate,omitempty"`
-	SuccessRateMinimumHosts            int           `json:"success_rate_minimum_hosts,omitempty"`
-	SuccessRateRequestVolume           int           `json:"success_rate_request_volume,omitempty"`
-	SuccessRateStdevFactor             int           `json:"success_rate_stdev_factor,omitempty"`
+	Consecutive5xx                     int             `json:"consecutive_5xx,omitempty"`
+	ConsecutiveGatewayFailure          int             `json:"consecutive_gateway_failure,omitempty"`
+	IntervalMS                         millis.Duration `json:"interval_ms,omitempty"`
+	BaseJjectionTimeMS                 millis.Duration `json:"base_ejection_time_ms,omitempty"`
+	MaxEjectionPercent                 *int            `json:"max_ejection_percent,omitempty"` // Percentages are pointers, as 0 differs from Envoy's default
+	EnforcingConsecutive5xx            *int            `json:"enforcing_consecutive_5xx,omitempty"`
+	EnforcingConsecutiveGatewayFailure *int            `json:"enforcing_consecutive_gateway_failure,omitempty"`
+	EnforcingSuccessRate               *int            `json:"enforcing_success_rate,omitempty"`
+	SuccessRateMinimumHosts            int             `json:"success_rate_minimum_hosts,omitempty"`
+	SuccessRateRequestVolume           int             `json:"success_rate_request_volume,omitempty"`
+	SuccessRateStdevFactor             int             `json:"success_rate_stdev_factor,omitempty"`
 }
@@ -0,0 +1,118 @@
+package cds
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jippi/consul-envoy/service/millis"
+	"github.com/jippi/consul-envoy/service/tags"
+)
+
+// clusterOption maps a Consul service tag / service meta option onto a cluster field
+type clusterOption struct {
+	key   string
+	apply func(cluster *Cluster, value string) error
+}
+
+// clusterOptions are the cluster options that can be configured per service
+var clusterOptions = []clusterOption{
+	{"lb_type", func(c *Cluster, value string) error {
+		if !validLBTypes[value] {
+			return fmt.Errorf("invalid load balancer type %q", value)
+		}
+		c.LBtype = value
+		return nil
+	}},
+	{"connect_timeout", func(c *Cluster, value string) error {
+		return parsePositiveDuration(value, &c.ConnectTimeoutMS)
+	}},
+	{"max_requests_per_connection", func(c *Cluster, value string) error {
+		return parsePositiveInt(value, &c.MaxRequestsPerConnection)
+	}},
+	{"per_connection_buffer_limit_bytes", func(c *Cluster, value string) error {
+		return parsePositiveInt(value, &c.PerConnectionBufferLimitBytes)
+	}},
+	{"outlier.consecutive_5xx", func(c *Cluster, value string) error {
+		return parsePositiveInt(value, &c.OutlierDetection.Consecutive5xx)
+	}},
+	{"outlier.consecutive_gateway_failure", func(c *Cluster, value string) error {
+		return parsePositiveInt(value, &c.OutlierDetection.ConsecutiveGatewayFailure)
+	}},
+	{"outlier.interval", func(c *Cluster, value string) error {
+		return parsePositiveDuration(value, &c.OutlierDetection.IntervalMS)
+	}},
+	{"outlier.base_ejection_time", func(c *Cluster, value string) error {
+		return parsePositiveDuration(value, &c.OutlierDetection.BaseJjectionTimeMS)
+	}},
+	{"outlier.max_ejection_percent", func(c *Cluster, value string) error {
+		return parsePercent(value, &c.OutlierDetection.MaxEjectionPercent)
+	}},
+	{"outlier.enforcing_consecutive_5xx", func(c *Cluster, value string) error {
+		return parsePercent(value, &c.OutlierDetection.EnforcingConsecutive5xx)
+	}},
+	{"outlier.enforcing_success_rate", func(c *Cluster, value string) error {
+		return parsePercent(value, &c.OutlierDetection.EnforcingSuccessRate)
+	}},
+}
+
+// applyOptions will apply the cluster options from Consul service tags and
+// service meta to the cluster. Invalid options are skipped and returned as errors
+func applyOptions(cluster *Cluster, serviceTags []string, meta map[string]string) []error {
+	errors := make([]error, 0)
+
+	for _, option := range clusterOptions {
+		value, ok := tags.Lookup(serviceTags, meta, option.key)
+		if !ok {
+			continue
+		}
+
+		if err := option.apply(cluster, value); err != nil {
+			errors = append(errors, fmt.Errorf("invalid option %s%s: %s", tags.Prefix, option.key, err))
+		}
+	}
+
+	return errors
+}
+
+func parsePositiveDuration(value string, field *millis.Duration) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	if d <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+
+	*field = millis.Duration(d)
+	return nil
+}
+
+func parsePositiveInt(value string, field *int) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+
+	if i <= 0 {
+		return fmt.Errorf("value must be positive")
+	}
+
+	*field = i
+	return nil
+}
+
+func parsePercent(value string, field **int) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+
+	if i < 0 || i > 100 {
+		return fmt.Errorf("value must be between 0 and 100")
+	}
+
+	*field = &i
+	return nil
+}
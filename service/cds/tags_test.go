@@ -0,0 +1,60 @@
+package cds
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+)
+
+func TestOutlierDetectionZeroPercent(t *testing.T) {
+	services := catalog.Services{
+		"api": {Name: "api", Local: true, Tags: []string{"envoy.outlier.enforcing_success_rate=0"}},
+		"web": {Name: "web", Local: true},
+	}
+	documents := map[string][]byte{
+		"api": []byte(`{"outlier_detection": {"enforcing_consecutive_gateway_failure": 0}}`),
+	}
+	metas := map[string]map[string]string{
+		"api": {"envoy_outlier_max_ejection_percent": "0"},
+	}
+
+	clusters := buildClusters(services, metas, documents)
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %d", len(clusters))
+	}
+
+	// An explicit 0 is sent to Envoy, as it differs from the default
+	data, err := json.Marshal(clusters[0].OutlierDetection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"max_ejection_percent":0`, `"enforcing_success_rate":0`, `"enforcing_consecutive_gateway_failure":0`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("expected %s in the outlier detection of api, got %s", field, data)
+		}
+	}
+	if strings.Contains(string(data), "enforcing_consecutive_5xx") {
+		t.Errorf("expected no enforcing_consecutive_5xx when unset, got %s", data)
+	}
+
+	// Unset percentages are left to Envoy
+	if data, _ := json.Marshal(clusters[1].OutlierDetection); string(data) != "{}" {
+		t.Errorf("expected an empty outlier detection for web, got %s", data)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	for _, value := range []string{"-1", "101", "ten"} {
+		var field *int
+		if err := parsePercent(value, &field); err == nil || field != nil {
+			t.Errorf("expected %q to be rejected, got %v", value, field)
+		}
+	}
+
+	var field *int
+	if err := parsePercent("0", &field); err != nil || field == nil || *field != 0 {
+		t.Errorf("expected 0 to be accepted, got %v, %v", field, err)
+	}
+}
@@ -1,25 +1,49 @@
 package cds
 
 import (
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/millis"
+	"github.com/jippi/consul-envoy/service/notify"
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultConnectTimeout is the connect timeout of clusters, unless configured otherwise
+const defaultConnectTimeout = millis.Duration(3 * time.Minute)
+
+// metaConcurrency is the number of concurrent Consul requests reading service meta
+const metaConcurrency = 8
+
 // Worker for CDS (Cluster Discovery Service)
 type Worker struct {
-	consul    *api.Client              // Consul API Client
-	response  Response                 // Pre-computed response for HTTP server
-	serviceCh chan map[string][]string // Consul services channel (with tags)
-	stopCh    chan interface{}         // Stop channel
+	consul    *api.Client            // Consul API Client
+	response  Response               // Pre-computed response for HTTP server
+	serviceCh chan catalog.Services  // Consul services channel (with tags)
+	kvCh      chan map[string][]byte // Consul KV documents channel
+	metaCh    chan serviceMetas      // Service meta read in the background
+	stopCh    chan interface{}       // Stop channel
+	updates   notify.Notifier        // Notifies subscribers about new responses
+}
+
+// serviceMetas is the service meta for each cluster, read for a generation of
+// the Consul services
+type serviceMetas struct {
+	generation int
+	metas      map[string]map[string]string
 }
 
 // NewWorker will return the struct for a CDS worker
-func NewWorker(consul *api.Client, serviceCh chan map[string][]string) *Worker {
+func NewWorker(consul *api.Client, serviceCh chan catalog.Services, kvCh chan map[string][]byte) *Worker {
 	return &Worker{
 		consul:    consul,
 		serviceCh: serviceCh,
+		kvCh:      kvCh,
+		metaCh:    make(chan serviceMetas),
 	}
 }
 
@@ -28,29 +52,47 @@ func NewWorker(consul *api.Client, serviceCh chan map[string][]string) *Worker {
 func (w *Worker) Start() {
 	w.stopCh = make(chan interface{})
 
+	var services catalog.Services
+	var metas map[string]map[string]string
+	documents := make(map[string][]byte)
+	generation := 0
+
 	for {
 		select {
 		case <-w.stopCh:
 			return
 
-		case services := <-w.serviceCh:
+		case services = <-w.serviceCh:
 			log.Info("Got services")
 
-			clusters := make([]Cluster, 0)
-
-			for name := range services {
-				clusters = append(clusters, Cluster{
-					Name:             name,
-					ServiceName:      name,
-					Type:             "sds",
-					LBtype:           "least_request",
-					ConnectTimeoutMS: 3 * time.Minute,
-					OutlierDetection: &OutlierDetection{},
-				})
+			// Reading the meta takes a request per service, so it is done in
+			// the background and the clusters are built with the previous
+			// meta until it completes
+			generation++
+			go w.readMetas(generation, services)
+
+		case result := <-w.metaCh:
+			if result.generation != generation {
+				log.Debug("Ignoring service meta of outdated services")
+				continue
 			}
 
-			w.response = Response{Clusters: clusters}
+			log.Info("Got service meta")
+			metas = result.metas
+
+		case kv := <-w.kvCh:
+			log.Info("Got KV documents")
+			documents = validDocuments(kv, documents)
+		}
+
+		response := Response{Clusters: buildClusters(services, metas, documents)}
+		if reflect.DeepEqual(response, w.response) {
+			log.Debug("Clusters did not change")
+			continue
 		}
+
+		w.response = response
+		w.updates.Notify()
 	}
 }
 
@@ -59,7 +101,114 @@ func (w *Worker) Stop() {
 	close(w.stopCh)
 }
 
+// Subscribe will return a channel notified each time the CDS response changes
+func (w *Worker) Subscribe() <-chan struct{} {
+	return w.updates.Subscribe()
+}
+
 // Response will return the pre-computed CDS response
 func (w *Worker) Response() Response {
 	return w.response
 }
+
+// Build will build the CDS response for the services, as the worker does
+// with the service meta and the KV documents (keyed relative to the KV prefix)
+func Build(services catalog.Services, metas map[string]map[string]string, kv map[string][]byte) Response {
+	return Response{Clusters: buildClusters(services, metas, validDocuments(kv, nil))}
+}
+
+// readMetas will send the service meta for each cluster to the worker, read
+// concurrently from the first instance of the service (or subset) in the
+// Consul catalog
+func (w *Worker) readMetas(generation int, services catalog.Services) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	metas := make(map[string]map[string]string)
+	names := make(chan string)
+
+	for i := 0; i < metaConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for name := range names {
+				meta, ok := w.serviceMeta(name, services[name])
+				if !ok {
+					continue
+				}
+
+				lock.Lock()
+				metas[name] = meta
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for name, service := range services {
+		if !service.Query {
+			names <- name
+		}
+	}
+	close(names)
+	wg.Wait()
+
+	select {
+	case w.metaCh <- serviceMetas{generation: generation, metas: metas}:
+	case <-w.stopCh:
+	}
+}
+
+// serviceMeta will read the service meta of a cluster from the Consul catalog
+func (w *Worker) serviceMeta(name string, service catalog.Service) (map[string]string, bool) {
+	q := &api.QueryOptions{AllowStale: true, Datacenter: service.Datacenter}
+	entries, _, err := w.consul.Catalog().Service(service.Name, service.Subset, q)
+	if err != nil {
+		log.WithField("service", name).Errorf("Could not read service meta: %s", err)
+		return nil, false
+	}
+
+	if len(entries) == 0 {
+		return nil, false
+	}
+
+	return entries[0].ServiceMeta, true
+}
+
+// buildClusters will build a cluster per Consul service and datacenter, tuned
+// by the service tags and meta, with the KV cluster documents applied on top
+func buildClusters(services catalog.Services, metas map[string]map[string]string, documents map[string][]byte) []Cluster {
+	clusters := make([]Cluster, 0)
+
+	for name, service := range services {
+		cluster := Cluster{
+			Name:             name,
+			ServiceName:      name,
+			Type:             "sds",
+			LBtype:           "least_request",
+			ConnectTimeoutMS: defaultConnectTimeout,
+			OutlierDetection: &OutlierDetection{},
+		}
+
+		for _, err := range applyOptions(&cluster, service.Tags, metas[name]) {
+			log.WithField("service", name).Warn(err)
+		}
+
+		if document, ok := documents[name]; ok {
+			override, err := applyDocument(cluster, document)
+			if err != nil {
+				log.WithField("service", name).Errorf("Ignoring cluster document: %s", err)
+			} else {
+				cluster = override
+			}
+		}
+
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	return clusters
+}
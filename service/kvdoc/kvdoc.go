@@ -0,0 +1,53 @@
+package kvdoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Parse will return the Consul KV documents under the prefix accepted by
+// parse, keyed by their key relative to the prefix. Rejected documents are
+// logged and the previous accepted document for the key is kept, so a bad
+// edit does not take down a working configuration
+func Parse(documents, previous map[string][]byte, prefix, kind string, parse func(name string, document []byte) error) map[string][]byte {
+	result := make(map[string][]byte)
+
+	for key, value := range documents {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, prefix)
+		if name == "" || len(value) == 0 {
+			continue
+		}
+
+		if err := parse(name, value); err != nil {
+			log.WithField("key", key).Errorf("Rejecting %s document: %s", kind, err)
+
+			if last, ok := previous[name]; ok {
+				result[name] = last
+			}
+			continue
+		}
+
+		result[name] = value
+	}
+
+	return result
+}
+
+// Decode will decode a JSON document, rejecting unknown fields
+func Decode(document []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("could not parse document: %s", err)
+	}
+
+	return nil
+}
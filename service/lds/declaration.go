@@ -0,0 +1,182 @@
+package lds
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jippi/consul-envoy/service/kvdoc"
+	"github.com/jippi/consul-envoy/service/millis"
+	"github.com/jippi/consul-envoy/service/rds"
+	"github.com/jippi/consul-envoy/service/tags"
+)
+
+// kvPrefix is the Consul KV path (relative to the consul-envoy KV prefix)
+// holding listener documents, one per listener
+const kvPrefix = "listeners/"
+
+// declaration of an extra listener, from the "envoy.listener" service tag or
+// a KV listener document
+type declaration struct {
+	Protocol   string `json:"protocol"`    // "http" or "tcp"
+	Address    string `json:"address"`     // IP address to listen on, defaults to the HTTP listener address
+	Port       int    `json:"port"`        // Port to listen on
+	Cluster    string `json:"cluster"`     // Cluster receiving all traffic
+	RouteTable string `json:"route_table"` // Route table used by a HTTP listener, instead of a cluster
+}
+
+// parseListenerTag will return the listeners declared by a service with the
+// "envoy.listener=<protocol>:<port>[,<protocol>:<port>]" tag, forwarding all
+// traffic to the service cluster
+func parseListenerTag(cluster string, serviceTags []string) ([]declaration, []error) {
+	value, ok := tags.Lookup(serviceTags, nil, "listener")
+	if !ok {
+		return nil, nil
+	}
+
+	declarations := make([]declaration, 0)
+	errors := make([]error, 0)
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			errors = append(errors, fmt.Errorf("invalid listener %q, expected <protocol>:<port>", item))
+			continue
+		}
+
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid listener %q: %s", item, err))
+			continue
+		}
+
+		decl := declaration{Protocol: parts[0], Port: port, Cluster: cluster}
+		if err := validateDeclaration(decl); err != nil {
+			errors = append(errors, fmt.Errorf("invalid listener %q: %s", item, err))
+			continue
+		}
+
+		declarations = append(declarations, decl)
+	}
+
+	return declarations, errors
+}
+
+// validDocuments will return the listener documents from Consul KV, keyed by
+// listener name. Invalid documents are logged and the previous valid document
+// for the listener is kept
+func validDocuments(documents, previous map[string][]byte) map[string][]byte {
+	return kvdoc.Parse(documents, previous, kvPrefix, "listener", func(_ string, document []byte) error {
+		_, err := parseDocument(document)
+		return err
+	})
+}
+
+// parseDocuments will return the declarations of the valid listener
+// documents, keyed by listener name
+func parseDocuments(documents map[string][]byte) map[string]declaration {
+	result := make(map[string]declaration, len(documents))
+	for name, document := range documents {
+		result[name], _ = parseDocument(document)
+	}
+
+	return result
+}
+
+// parseDocument will parse and validate a listener document
+func parseDocument(document []byte) (declaration, error) {
+	decl := declaration{}
+
+	if err := kvdoc.Decode(document, &decl); err != nil {
+		return decl, err
+	}
+
+	if (decl.Cluster == "") == (decl.RouteTable == "") {
+		return decl, fmt.Errorf("exactly one of cluster or route_table must be set")
+	}
+
+	if decl.RouteTable != "" && decl.Protocol != "http" {
+		return decl, fmt.Errorf("route_table requires protocol \"http\"")
+	}
+
+	return decl, validateDeclaration(decl)
+}
+
+// validateDeclaration will check that a listener can be built from the declaration
+func validateDeclaration(decl declaration) error {
+	if decl.Protocol != "http" && decl.Protocol != "tcp" {
+		return fmt.Errorf("protocol must be \"http\" or \"tcp\", got %q", decl.Protocol)
+	}
+
+	if decl.Port <= 0 || decl.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", decl.Port)
+	}
+
+	if decl.Address != "" && net.ParseIP(decl.Address) == nil {
+		return fmt.Errorf("address must be an IP address, got %q", decl.Address)
+	}
+
+	return nil
+}
+
+// buildListener will build the listener for a declaration, HTTP listeners
+// either use a route table from RDS or route all requests to the cluster
+// with an inline route configuration
+func buildListener(name string, decl declaration, config Config) Listener {
+	listener := Listener{
+		Name:    name,
+		Address: fmt.Sprintf("tcp://%s:%d", decl.Address, decl.Port),
+	}
+
+	if decl.Protocol == "tcp" {
+		listener.Filters = []Filter{{
+			Name: "tcp_proxy",
+			Config: &TCPProxy{
+				StatPrefix: name,
+				RouteConfig: TCPRouteConfig{
+					Routes: []TCPRoute{{Cluster: decl.Cluster}},
+				},
+			},
+		}}
+
+		return listener
+	}
+
+	if decl.RouteTable != "" {
+		listener.Filters = []Filter{{
+			Name: "http_connection_manager",
+			Config: &HTTPConnectionManager{
+				CodecType:  "auto",
+				StatPrefix: name,
+				RDS: &RDS{
+					Cluster:         config.RDSCluster,
+					RouteConfigName: decl.RouteTable,
+					RefreshDelayMS:  millis.Duration(10 * time.Second),
+				},
+				Filters: []HTTPFilter{{Name: "router"}},
+			},
+		}}
+
+		return listener
+	}
+
+	listener.Filters = []Filter{{
+		Name: "http_connection_manager",
+		Config: &HTTPConnectionManager{
+			CodecType:  "auto",
+			StatPrefix: name,
+			RouteConfig: &rds.Response{
+				VirtualHosts: []rds.VirtualHost{{
+					Name:    name,
+					Domains: []string{"*"},
+					Routes:  []rds.Route{{Prefix: "/", Cluster: decl.Cluster}},
+				}},
+			},
+			Filters: []HTTPFilter{{Name: "router"}},
+		},
+	}}
+
+	return listener
+}
@@ -0,0 +1,56 @@
+package lds
+
+// Scoped will return the response with only the listeners sending traffic to
+// clusters allowed by the filter. Listeners using RDS are kept, as their routes
+// are scoped by RDS
+func (r Response) Scoped(allows func(cluster string) bool) Response {
+	listeners := make([]Listener, 0, len(r.Listeners))
+	for _, listener := range r.Listeners {
+		if allowsAll(listener.Clusters(), allows) {
+			listeners = append(listeners, listener)
+		}
+	}
+
+	return Response{Listeners: listeners}
+}
+
+// Clusters will return the clusters the listener sends traffic to, from the
+// TCP proxy routes and the inline route configuration (including shadows)
+func (l Listener) Clusters() []string {
+	clusters := make([]string, 0)
+	for _, filter := range l.Filters {
+		switch config := filter.Config.(type) {
+		case *TCPProxy:
+			for _, route := range config.RouteConfig.Routes {
+				clusters = append(clusters, route.Cluster)
+			}
+
+		case *HTTPConnectionManager:
+			if config.RouteConfig == nil {
+				continue
+			}
+
+			for _, vhost := range config.RouteConfig.VirtualHosts {
+				for _, route := range vhost.Routes {
+					clusters = append(clusters, route.Clusters()...)
+					if route.Shadow != nil {
+						clusters = append(clusters, route.Shadow.Cluster)
+					}
+				}
+			}
+		}
+	}
+
+	return clusters
+}
+
+// allowsAll will return true if the filter allows all clusters
+func allowsAll(clusters []string, allows func(cluster string) bool) bool {
+	for _, cluster := range clusters {
+		if !allows(cluster) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,59 @@
+package lds
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+)
+
+func TestResponseScoped(t *testing.T) {
+	services := catalog.Services{
+		"billing": {Name: "billing", Local: true, Tags: []string{"envoy.listener=tcp:9000"}},
+		"web":     {Name: "web", Local: true, Tags: []string{"envoy.listener=http:8081"}},
+	}
+	documents := map[string]declaration{
+		"internal": {Protocol: "http", Port: 8082, RouteTable: "internal"},
+	}
+	response := buildResponse(Config{ListenerPort: 80}, services, documents)
+
+	tests := []struct {
+		name     string
+		allows   func(cluster string) bool
+		expected []string
+	}{
+		{
+			name:     "all clusters allowed",
+			allows:   func(string) bool { return true },
+			expected: []string{"http", "billing_tcp_9000", "internal", "web_http_8081"},
+		},
+		{
+			name:     "TCP proxy cluster disallowed",
+			allows:   func(cluster string) bool { return cluster == "web" },
+			expected: []string{"http", "internal", "web_http_8081"},
+		},
+		{
+			name:     "inline route cluster disallowed",
+			allows:   func(cluster string) bool { return cluster == "billing" },
+			expected: []string{"http", "billing_tcp_9000", "internal"},
+		},
+		{
+			name:     "RDS listeners are kept",
+			allows:   func(string) bool { return false },
+			expected: []string{"http", "internal"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names := make([]string, 0)
+			for _, listener := range response.Scoped(test.allows).Listeners {
+				names = append(names, listener.Name)
+			}
+
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected listeners %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
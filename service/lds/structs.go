@@ -0,0 +1,63 @@
+package lds
+
+import (
+	"github.com/jippi/consul-envoy/service/millis"
+	"github.com/jippi/consul-envoy/service/rds"
+)
+
+// Response for a LDS request
+type Response struct {
+	Listeners []Listener `json:"listeners"`
+}
+
+// Listener response ...
+type Listener struct {
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Filters []Filter `json:"filters"`
+}
+
+// Filter response ...
+type Filter struct {
+	Name   string      `json:"name"`
+	Config interface{} `json:"config"` // *HTTPConnectionManager or *TCPProxy
+}
+
+// HTTPConnectionManager response ...
+type HTTPConnectionManager struct {
+	CodecType        string        `json:"codec_type"`
+	StatPrefix       string        `json:"stat_prefix"`
+	UseRemoteAddress bool          `json:"use_remote_address,omitempty"`
+	RDS              *RDS          `json:"rds,omitempty"`
+	RouteConfig      *rds.Response `json:"route_config,omitempty"`
+	Filters          []HTTPFilter  `json:"filters"`
+}
+
+// RDS response ...
+type RDS struct {
+	Cluster         string          `json:"cluster"`
+	RouteConfigName string          `json:"route_config_name"`
+	RefreshDelayMS  millis.Duration `json:"refresh_delay_ms,omitempty"`
+}
+
+// HTTPFilter response ...
+type HTTPFilter struct {
+	Name   string   `json:"name"`
+	Config struct{} `json:"config"`
+}
+
+// TCPProxy response ...
+type TCPProxy struct {
+	StatPrefix  string         `json:"stat_prefix"`
+	RouteConfig TCPRouteConfig `json:"route_config"`
+}
+
+// TCPRouteConfig response ...
+type TCPRouteConfig struct {
+	Routes []TCPRoute `json:"routes"`
+}
+
+// TCPRoute response ...
+type TCPRoute struct {
+	Cluster string `json:"cluster"`
+}
@@ -0,0 +1,169 @@
+package lds
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/millis"
+	"github.com/jippi/consul-envoy/service/notify"
+	"github.com/jippi/consul-envoy/service/rds"
+	log "github.com/sirupsen/logrus"
+)
+
+// Worker for LDS (Listener Discovery Service)
+type Worker struct {
+	config    Config                 // LDS configuration
+	response  Response               // Pre-computed response for HTTP server
+	serviceCh chan catalog.Services  // Consul services channel (with tags)
+	kvCh      chan map[string][]byte // Consul KV documents channel
+	stopCh    chan interface{}       // Stop channel
+	updates   notify.Notifier        // Notifies subscribers about new responses
+}
+
+// Config for the LDS worker
+type Config struct {
+	ListenerAddress string // IP address for the HTTP listener
+	ListenerPort    int    // Port for the HTTP listener
+	RDSCluster      string // Name of the Envoy cluster serving RDS (v1 only)
+}
+
+// NewWorker will return the struct for a LDS worker
+func NewWorker(serviceCh chan catalog.Services, kvCh chan map[string][]byte, config Config) *Worker {
+	return &Worker{
+		config:    config,
+		serviceCh: serviceCh,
+		kvCh:      kvCh,
+		stopCh:    make(chan interface{}),
+	}
+}
+
+// Start will start the LDS worker, listening for service channel changes
+// and pre-build LDS HTTP response
+func (w *Worker) Start() {
+	var services catalog.Services
+	documents := make(map[string][]byte)
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+
+		case services = <-w.serviceCh:
+			log.Info("Got services")
+
+		case kv := <-w.kvCh:
+			log.Info("Got KV documents")
+			documents = validDocuments(kv, documents)
+		}
+
+		response := buildResponse(w.config, services, parseDocuments(documents))
+		if reflect.DeepEqual(response, w.response) {
+			log.Debug("Listeners did not change")
+			continue
+		}
+
+		w.response = response
+		w.updates.Notify()
+	}
+}
+
+// Stop the LDS worker
+func (w *Worker) Stop() {
+	close(w.stopCh)
+}
+
+// Subscribe will return a channel notified each time the LDS response changes
+func (w *Worker) Subscribe() <-chan struct{} {
+	return w.updates.Subscribe()
+}
+
+// Response will return the pre-computed LDS response
+func (w *Worker) Response() Response {
+	return w.response
+}
+
+// Build will build the LDS response for the services, as the worker does with
+// the KV documents (keyed relative to the KV prefix)
+func Build(config Config, services catalog.Services, kv map[string][]byte) Response {
+	return buildResponse(config, services, parseDocuments(validDocuments(kv, nil)))
+}
+
+// buildResponse will build the HTTP listener using RDS, and the extra
+// listeners declared by local services and KV documents. When listeners
+// share a port, the first listener (by name) wins
+func buildResponse(config Config, services catalog.Services, documents map[string]declaration) Response {
+	declarations := make(map[string]declaration)
+
+	for name, service := range services {
+		// Listeners are only declared by services in the local datacenter,
+		// as the same service in other datacenters (or its subsets) would
+		// claim the same ports
+		if !service.Local || service.Query || service.Subset != "" {
+			continue
+		}
+
+		decls, errors := parseListenerTag(name, service.Tags)
+		for _, err := range errors {
+			log.WithField("service", name).Warn(err)
+		}
+
+		for _, decl := range decls {
+			declarations[fmt.Sprintf("%s_%s_%d", name, decl.Protocol, decl.Port)] = decl
+		}
+	}
+
+	for name, decl := range documents {
+		declarations[name] = decl
+	}
+
+	names := make([]string, 0, len(declarations))
+	for name := range declarations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	listeners := []Listener{httpListener(config)}
+	ports := map[int]string{config.ListenerPort: listeners[0].Name}
+
+	for _, name := range names {
+		decl := declarations[name]
+		if decl.Address == "" {
+			decl.Address = config.ListenerAddress
+		}
+
+		if owner, ok := ports[decl.Port]; ok {
+			log.WithField("listener", name).Errorf("Port %d is already used by listener %s", decl.Port, owner)
+			continue
+		}
+		ports[decl.Port] = name
+
+		listeners = append(listeners, buildListener(name, decl, config))
+	}
+
+	return Response{Listeners: listeners}
+}
+
+// httpListener will return the HTTP listener routing requests with RDS
+func httpListener(config Config) Listener {
+	return Listener{
+		Name:    "http",
+		Address: fmt.Sprintf("tcp://%s:%d", config.ListenerAddress, config.ListenerPort),
+		Filters: []Filter{{
+			Name: "http_connection_manager",
+			Config: &HTTPConnectionManager{
+				CodecType:        "auto",
+				StatPrefix:       "http",
+				UseRemoteAddress: true,
+				RDS: &RDS{
+					Cluster:         config.RDSCluster,
+					RouteConfigName: rds.DefaultRouteTable,
+					RefreshDelayMS:  millis.Duration(10 * time.Second),
+				},
+				Filters: []HTTPFilter{{Name: "router"}},
+			},
+		}},
+	}
+}
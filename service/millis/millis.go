@@ -0,0 +1,27 @@
+package millis
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration encoded in JSON as whole milliseconds, as used
+// by the "*_ms" fields of the Envoy v1 API
+type Duration time.Duration
+
+// MarshalJSON will encode the duration as milliseconds
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(time.Duration(d)/time.Millisecond), 10)), nil
+}
+
+// UnmarshalJSON will decode the duration from milliseconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var ms int64
+	if err := json.Unmarshal(data, &ms); err != nil {
+		return err
+	}
+
+	*d = Duration(time.Duration(ms) * time.Millisecond)
+	return nil
+}
@@ -0,0 +1,53 @@
+package notify
+
+import "sync"
+
+// Notifier broadcasts change notifications to its subscribers, without ever
+// blocking the notifying worker
+type Notifier struct {
+	lock        sync.Mutex
+	subscribers []chan struct{}
+	notified    bool // Whether a change was notified, told to late subscribers
+}
+
+// Subscribe will return a channel receiving a value after each change.
+// Changes happening while the subscriber is busy are coalesced into one, and
+// a subscriber joining after a change receives a value right away
+func (n *Notifier) Subscribe() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if n.notified {
+		ch <- struct{}{}
+	}
+	n.subscribers = append(n.subscribers, ch)
+	return ch
+}
+
+// Notify all subscribers about a change
+func (n *Notifier) Notify() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.notified = true
+	for _, ch := range n.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Unsubscribe will stop notifying a channel returned by Subscribe
+func (n *Notifier) Unsubscribe(ch <-chan struct{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for i, subscriber := range n.subscribers {
+		if subscriber == ch {
+			n.subscribers = append(n.subscribers[:i], n.subscribers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/kvdoc"
+	"github.com/jippi/consul-envoy/service/tags"
+)
+
+// kvPrefix is the Consul KV path (relative to the consul-envoy KV prefix)
+// holding policy documents, one per Envoy service cluster
+const kvPrefix = "policies/"
+
+// Policy decides which clusters (and the routes to them) an Envoy service
+// cluster receives. A nil policy allows all clusters
+type Policy struct {
+	Upstreams []string `json:"upstreams"` // Cluster name patterns, in path.Match syntax (e.g. "billing-*")
+}
+
+// Allows will return true if the policy allows the cluster
+func (p *Policy) Allows(cluster string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, pattern := range p.Upstreams {
+		if ok, _ := path.Match(pattern, cluster); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate will check that all upstream patterns are valid
+func (p *Policy) validate() error {
+	for _, pattern := range p.Upstreams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid upstream pattern %q: %s", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// parseUpstreamsTag will return the policy declared by a service with the
+// "envoy.upstreams=<pattern>[,<pattern>]" tag
+func parseUpstreamsTag(serviceTags []string) (*Policy, error) {
+	value, ok := tags.Lookup(serviceTags, nil, "upstreams")
+	if !ok {
+		return nil, nil
+	}
+
+	policy := &Policy{Upstreams: make([]string, 0)}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			policy.Upstreams = append(policy.Upstreams, pattern)
+		}
+	}
+
+	return policy, policy.validate()
+}
+
+// validDocuments will return the policy documents from Consul KV, keyed by
+// Envoy service cluster. Invalid documents are logged and the previous valid
+// document for the service cluster is kept
+func validDocuments(documents, previous map[string][]byte) map[string][]byte {
+	return kvdoc.Parse(documents, previous, kvPrefix, "policy", func(_ string, document []byte) error {
+		_, err := parseDocument(document)
+		return err
+	})
+}
+
+// parseDocuments will return the policies of the valid policy documents,
+// keyed by Envoy service cluster
+func parseDocuments(documents map[string][]byte) map[string]*Policy {
+	result := make(map[string]*Policy, len(documents))
+	for serviceCluster, document := range documents {
+		result[serviceCluster], _ = parseDocument(document)
+	}
+
+	return result
+}
+
+// parseDocument will parse and validate a policy document
+func parseDocument(document []byte) (*Policy, error) {
+	policy := &Policy{}
+
+	if err := kvdoc.Decode(document, policy); err != nil {
+		return nil, err
+	}
+
+	if policy.Upstreams == nil {
+		return nil, fmt.Errorf("upstreams is required, use [] to allow no clusters")
+	}
+
+	return policy, policy.validate()
+}
@@ -0,0 +1,100 @@
+package policy
+
+import (
+	"reflect"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+// Worker for the policies scoping CDS and RDS responses per Envoy service cluster
+type Worker struct {
+	policies  map[string]*Policy     // Policies, keyed by Envoy service cluster
+	serviceCh chan catalog.Services  // Consul services channel (with tags)
+	kvCh      chan map[string][]byte // Consul KV documents channel
+	stopCh    chan interface{}       // Stop channel
+	updates   notify.Notifier        // Notifies subscribers about new policies
+}
+
+// NewWorker will return the struct for a policy worker
+func NewWorker(serviceCh chan catalog.Services, kvCh chan map[string][]byte) *Worker {
+	return &Worker{
+		serviceCh: serviceCh,
+		kvCh:      kvCh,
+		stopCh:    make(chan interface{}),
+	}
+}
+
+// Start will start the policy worker, listening for service and KV changes
+func (w *Worker) Start() {
+	var services catalog.Services
+	documents := make(map[string][]byte)
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+
+		case services = <-w.serviceCh:
+			log.Info("Got services")
+
+		case kv := <-w.kvCh:
+			log.Info("Got KV documents")
+			documents = validDocuments(kv, documents)
+		}
+
+		policies := buildPolicies(services, parseDocuments(documents))
+		if reflect.DeepEqual(policies, w.policies) {
+			continue
+		}
+
+		w.policies = policies
+		w.updates.Notify()
+	}
+}
+
+// Stop the policy worker
+func (w *Worker) Stop() {
+	close(w.stopCh)
+}
+
+// Subscribe will return a channel notified each time the policies change
+func (w *Worker) Subscribe() <-chan struct{} {
+	return w.updates.Subscribe()
+}
+
+// Policy will return the policy for an Envoy service cluster, nil (allowing
+// all clusters) if there is none
+func (w *Worker) Policy(serviceCluster string) *Policy {
+	return w.policies[serviceCluster]
+}
+
+// buildPolicies will return the policy for each Envoy service cluster, from
+// the "envoy.upstreams" tag of the local Consul service with the same name and
+// the KV policy documents, which win over the tag
+func buildPolicies(services catalog.Services, documents map[string]*Policy) map[string]*Policy {
+	policies := make(map[string]*Policy)
+
+	for name, service := range services {
+		if !service.Local || service.Query || service.Subset != "" {
+			continue
+		}
+
+		policy, err := parseUpstreamsTag(service.Tags)
+		if err != nil {
+			log.WithField("service", name).Warnf("Ignoring upstreams tag: %s", err)
+			continue
+		}
+
+		if policy != nil {
+			policies[name] = policy
+		}
+	}
+
+	for serviceCluster, policy := range documents {
+		policies[serviceCluster] = policy
+	}
+
+	return policies
+}
@@ -0,0 +1,67 @@
+package rds
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jippi/consul-envoy/service/kvdoc"
+)
+
+// kvPrefix is the Consul KV path (relative to the consul-envoy KV prefix)
+// holding route documents, one per service
+const kvPrefix = "routes/"
+
+// validDocuments will return the route documents from Consul KV, keyed by
+// service name. Invalid documents are logged and the previous valid document
+// for the service is kept
+func validDocuments(documents, previous map[string][]byte) map[string][]byte {
+	return kvdoc.Parse(documents, previous, kvPrefix, "route", func(service string, document []byte) error {
+		_, err := parseDocument(service, document)
+		return err
+	})
+}
+
+// parseDocuments will return the valid route documents as rules for the
+// service virtual hosts
+func parseDocuments(documents map[string][]byte) map[string]RuleVirtualHost {
+	result := make(map[string]RuleVirtualHost, len(documents))
+	for service, document := range documents {
+		result[service], _ = parseDocument(service, document)
+	}
+
+	return result
+}
+
+// parseDocument will parse and validate a route document for a service
+func parseDocument(service string, document []byte) (RuleVirtualHost, error) {
+	vhost := RuleVirtualHost{}
+
+	if err := kvdoc.Decode(document, &vhost); err != nil {
+		return vhost, err
+	}
+
+	if vhost.Name != "" && vhost.Name != service {
+		return vhost, fmt.Errorf("name must be empty or %q", service)
+	}
+	vhost.Name = service
+
+	if err := validateVirtualHost(vhost); err != nil {
+		return vhost, err
+	}
+
+	return vhost, nil
+}
+
+// documentRules will return the route documents as routing rules, ordered by service name
+func documentRules(documents map[string]RuleVirtualHost) *Rules {
+	rules := &Rules{}
+	for _, vhost := range documents {
+		rules.VirtualHosts = append(rules.VirtualHosts, vhost)
+	}
+
+	sort.Slice(rules.VirtualHosts, func(i, j int) bool {
+		return rules.VirtualHosts[i].Name < rules.VirtualHosts[j].Name
+	})
+
+	return rules
+}
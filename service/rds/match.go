@@ -0,0 +1,231 @@
+package rds
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Request is a HTTP request to match against the virtual hosts and routes
+type Request struct {
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Match is the result of matching a request, with the route actions applied
+type Match struct {
+	VirtualHost      string            `json:"virtual_host,omitempty"`
+	Route            *Route            `json:"route,omitempty"`
+	Cluster          string            `json:"cluster,omitempty"`
+	WeightedClusters *WeightedClusters `json:"weighted_clusters,omitempty"` // Clusters the traffic is split between, instead of Cluster
+	Redirect         string            `json:"redirect,omitempty"`          // Redirect location, for redirect routes
+	Status           int               `json:"status,omitempty"`            // Status answered by Envoy, for direct responses
+	PrefixRewrite    string            `json:"prefix_rewrite,omitempty"`
+	HostRewrite      string            `json:"host_rewrite,omitempty"`
+	AutoHostRewrite  bool              `json:"auto_host_rewrite,omitempty"`
+	Path             string            `json:"path,omitempty"` // Path sent upstream, after rewrites
+	RetryPolicy      *RetryPolicy      `json:"retry_policy,omitempty"`
+	Shadow           *Shadow           `json:"shadow,omitempty"`
+}
+
+// Matched will return true if a route was found for the request
+func (m Match) Matched() bool {
+	return m.Route != nil
+}
+
+// Match will find the route for a request the way Envoy does: the virtual
+// host is selected by exact domain, then the longest wildcard suffix domain
+// ("*.example.com") and finally the "*" domain, and the first route of the
+// virtual host matching the path and headers wins. An empty path is matched
+// as "/"
+func (r Response) Match(request Request) Match {
+	if request.Path == "" {
+		request.Path = "/"
+	}
+
+	vhost := r.matchVirtualHost(strings.ToLower(request.Host))
+	if vhost == nil {
+		return Match{}
+	}
+
+	result := Match{VirtualHost: vhost.Name}
+
+	for i := range vhost.Routes {
+		route := &vhost.Routes[i]
+		if !matchPath(*route, request.Path) || !matchHeaders(route.Headers, request) {
+			continue
+		}
+
+		result.Route = route
+		result.Cluster = route.Cluster
+		result.WeightedClusters = route.WeightedClusters
+		result.RetryPolicy = route.RetryPolicy
+		result.Shadow = route.Shadow
+		result.Path = request.Path
+		result.HostRewrite = route.HostRewrite
+		result.AutoHostRewrite = route.AutoHostRewrite
+
+		if route.DirectResponse != nil {
+			result.Status = route.DirectResponse.Status
+			result.Cluster = ""
+			result.WeightedClusters = nil
+			result.Path = ""
+			return result
+		}
+
+		if route.HostRedirect != "" || route.PathRedirect != "" {
+			host, path := request.Host, request.Path
+			if route.HostRedirect != "" {
+				host = route.HostRedirect
+			}
+			if route.PathRedirect != "" {
+				path = route.PathRedirect
+			}
+			result.Redirect = host + path
+			result.Cluster = ""
+			result.WeightedClusters = nil
+			result.Path = ""
+			return result
+		}
+
+		if route.PrefixRewrite != "" {
+			result.PrefixRewrite = route.PrefixRewrite
+			result.Path = rewritePath(*route, request.Path)
+		}
+
+		return result
+	}
+
+	return result
+}
+
+// matchVirtualHost will return the virtual host serving the host
+func (r Response) matchVirtualHost(host string) *VirtualHost {
+	type wildcard struct {
+		suffix string
+		vhost  *VirtualHost
+	}
+
+	var fallback *VirtualHost
+	wildcards := make([]wildcard, 0)
+
+	for i := range r.VirtualHosts {
+		vhost := &r.VirtualHosts[i]
+		for _, domain := range vhost.Domains {
+			domain = strings.ToLower(domain)
+
+			switch {
+			case domain == host:
+				return vhost
+			case domain == "*":
+				fallback = vhost
+			case strings.HasPrefix(domain, "*"):
+				wildcards = append(wildcards, wildcard{suffix: domain[1:], vhost: vhost})
+			}
+		}
+	}
+
+	sort.SliceStable(wildcards, func(i, j int) bool {
+		return len(wildcards[i].suffix) > len(wildcards[j].suffix)
+	})
+
+	for _, w := range wildcards {
+		// The wildcard must match at least one character
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.vhost
+		}
+	}
+
+	return fallback
+}
+
+// matchPath will return true if the route matches the path, prefix routes
+// match the full path including the query string, path and regex routes the
+// path without the query string. Prefix and path routes ignore the case when
+// case_sensitive is false, regex routes are always case sensitive
+func matchPath(route Route, path string) bool {
+	withoutQuery := path
+	if i := strings.IndexAny(path, "?#"); i != -1 {
+		withoutQuery = path[:i]
+	}
+
+	ignoreCase := route.CaseSensitive != nil && !*route.CaseSensitive
+
+	switch {
+	case route.Prefix != "" && ignoreCase:
+		return strings.HasPrefix(strings.ToLower(path), strings.ToLower(route.Prefix))
+	case route.Prefix != "":
+		return strings.HasPrefix(path, route.Prefix)
+	case route.Path != "" && ignoreCase:
+		return strings.EqualFold(withoutQuery, route.Path)
+	case route.Path != "":
+		return withoutQuery == route.Path
+	case route.Regex != "":
+		re, err := regexp.Compile("^(?:" + route.Regex + ")$")
+		return err == nil && re.MatchString(withoutQuery)
+	default:
+		return false
+	}
+}
+
+// matchHeaders will return true if the request matches all header matchers,
+// the method is matched as the ":method" header like Envoy does
+func matchHeaders(headers []Header, request Request) bool {
+	for _, header := range headers {
+		value, ok := requestHeader(request, header.Name)
+		if !ok {
+			return false
+		}
+
+		switch {
+		case header.Regex:
+			re, err := regexp.Compile("^(?:" + header.Value + ")$")
+			if err != nil || !re.MatchString(value) {
+				return false
+			}
+		case header.Value != "":
+			if value != header.Value {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// requestHeader will return a request header by case insensitive name,
+// including the ":method", ":authority" and ":path" pseudo headers
+func requestHeader(request Request, name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case ":method":
+		return request.Method, request.Method != ""
+	case ":authority", "host":
+		return request.Host, true
+	case ":path":
+		return request.Path, true
+	}
+
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// rewritePath will return the path sent upstream after the prefix rewrite,
+// which only applies to prefix and path routes. The route matched the path,
+// so its matcher is replaced by length as the case may differ
+func rewritePath(route Route, path string) string {
+	switch {
+	case route.Prefix != "":
+		return route.PrefixRewrite + path[len(route.Prefix):]
+	case route.Path != "":
+		return route.PrefixRewrite + path[len(route.Path):]
+	default:
+		return path
+	}
+}
@@ -0,0 +1,82 @@
+package rds
+
+import "testing"
+
+func TestResponseMatch(t *testing.T) {
+	insensitive := false
+	response := Response{VirtualHosts: []VirtualHost{
+		{
+			Name:    "api",
+			Domains: []string{"api.example.com"},
+			Routes: []Route{
+				{Path: "/Health", Cluster: "api-health"},
+				{Prefix: "/Users", Cluster: "api-users", CaseSensitive: &insensitive, PrefixRewrite: "/v2/users"},
+				{Regex: "/orders/[0-9]+", Cluster: "api-orders", CaseSensitive: &insensitive},
+				{Prefix: "/admin", Cluster: "api-admin", Headers: []Header{{Name: "X-Admin", Value: "yes"}}},
+				{Path: "/Status", Cluster: "api-status", CaseSensitive: &insensitive},
+				{Prefix: "/", Cluster: "api"},
+			},
+		},
+		{
+			Name:    "wildcard",
+			Domains: []string{"*.example.com"},
+			Routes:  []Route{{Prefix: "/", Cluster: "wildcard"}},
+		},
+		{
+			Name:    "default",
+			Domains: []string{"*"},
+			Routes:  []Route{{Prefix: "/old", HostRedirect: "new.example.com"}, {Prefix: "/", Cluster: "default"}},
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		request     Request
+		virtualHost string
+		cluster     string
+		path        string
+		redirect    string
+	}{
+		{name: "exact domain", request: Request{Host: "API.example.com", Path: "/"}, virtualHost: "api", cluster: "api", path: "/"},
+		{name: "empty path matches as /", request: Request{Host: "api.example.com"}, virtualHost: "api", cluster: "api", path: "/"},
+		{name: "path is case sensitive by default", request: Request{Host: "api.example.com", Path: "/health"}, virtualHost: "api", cluster: "api", path: "/health"},
+		{name: "path", request: Request{Host: "api.example.com", Path: "/Health?verbose=1"}, virtualHost: "api", cluster: "api-health", path: "/Health?verbose=1"},
+		{name: "case insensitive prefix", request: Request{Host: "api.example.com", Path: "/users/42"}, virtualHost: "api", cluster: "api-users", path: "/v2/users/42"},
+		{name: "case insensitive path", request: Request{Host: "api.example.com", Path: "/STATUS"}, virtualHost: "api", cluster: "api-status", path: "/STATUS"},
+		{name: "regex stays case sensitive", request: Request{Host: "api.example.com", Path: "/ORDERS/1"}, virtualHost: "api", cluster: "api", path: "/ORDERS/1"},
+		{name: "regex", request: Request{Host: "api.example.com", Path: "/orders/1"}, virtualHost: "api", cluster: "api-orders", path: "/orders/1"},
+		{name: "header mismatch falls through", request: Request{Host: "api.example.com", Path: "/admin"}, virtualHost: "api", cluster: "api", path: "/admin"},
+		{name: "header", request: Request{Host: "api.example.com", Path: "/admin", Headers: map[string]string{"x-admin": "yes"}}, virtualHost: "api", cluster: "api-admin", path: "/admin"},
+		{name: "wildcard domain", request: Request{Host: "web.example.com", Path: "/"}, virtualHost: "wildcard", cluster: "wildcard", path: "/"},
+		{name: "wildcard needs a character", request: Request{Host: ".example.com", Path: "/"}, virtualHost: "default", cluster: "default", path: "/"},
+		{name: "redirect", request: Request{Host: "other.org", Path: "/old/page"}, virtualHost: "default", redirect: "new.example.com/old/page"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := response.Match(test.request)
+			if !match.Matched() {
+				t.Fatal("expected a route to match")
+			}
+
+			if match.VirtualHost != test.virtualHost || match.Cluster != test.cluster || match.Path != test.path || match.Redirect != test.redirect {
+				t.Errorf("expected virtual host %q, cluster %q, path %q and redirect %q, got %q, %q, %q and %q",
+					test.virtualHost, test.cluster, test.path, test.redirect, match.VirtualHost, match.Cluster, match.Path, match.Redirect)
+			}
+		})
+	}
+}
+
+func TestResponseMatchNoRoute(t *testing.T) {
+	response := Response{VirtualHosts: []VirtualHost{{
+		Name:    "api",
+		Domains: []string{"api.example.com"},
+		Routes:  []Route{{Prefix: "/api", Cluster: "api"}},
+	}}}
+
+	for _, request := range []Request{{Host: "web.example.com", Path: "/api"}, {Host: "api.example.com", Path: "/"}} {
+		if match := response.Match(request); match.Matched() {
+			t.Errorf("expected no route for %s%s, got %s", request.Host, request.Path, match.Cluster)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package rds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Rules is a declarative routing rules file, adding routes to the generated
+// virtual hosts or declaring new virtual hosts
+type Rules struct {
+	VirtualHosts []RuleVirtualHost `json:"virtual_hosts"`
+}
+
+// RuleVirtualHost is a virtual host in the routing rules file
+//
+// If the name matches a generated virtual host (e.g. a Consul service name),
+// the domains are added to it and the routes are placed in front of the
+// generated routes (or replace them). Otherwise a new virtual host is created.
+//
+// Without route tables, a virtual host extending a service is part of the
+// route tables of the service, and a new virtual host of the default table.
+type RuleVirtualHost struct {
+	Name        string      `json:"name"`
+	Domains     []string    `json:"domains,omitempty"`
+	Routes      []RuleRoute `json:"routes"`
+	Replace     bool        `json:"replace,omitempty"`      // Replace the generated routes instead of extending them
+	RouteTables []string    `json:"route_tables,omitempty"` // Route tables the virtual host is part of
+}
+
+// RuleRoute is a route in the routing rules file, in the Envoy route format
+// with a "strip" shortcut for services mounted below a path
+type RuleRoute struct {
+	Route
+	Strip string `json:"strip,omitempty"` // Prefix removed from the path before forwarding the request
+}
+
+// envoyRoutes will return the Envoy routes, with the strip shortcut applied
+func (r RuleRoute) envoyRoutes() ([]Route, error) {
+	if r.Strip == "" {
+		return []Route{r.Route}, nil
+	}
+
+	if r.PrefixRewrite != "" {
+		return nil, fmt.Errorf("strip and prefix_rewrite are mutually exclusive")
+	}
+
+	return stripPrefix(r.Route, r.Strip)
+}
+
+// envoyRoutes will return the Envoy routes of a validated rules virtual host
+func (vhost RuleVirtualHost) envoyRoutes() []Route {
+	routes := make([]Route, 0, len(vhost.Routes))
+	for _, rule := range vhost.Routes {
+		envoyRoutes, err := rule.envoyRoutes()
+		if err != nil {
+			log.WithField("virtual_host", vhost.Name).Warnf("Skipping route: %s", err)
+			continue
+		}
+		routes = append(routes, envoyRoutes...)
+	}
+
+	return routes
+}
+
+// LoadRules will read, parse and validate a routing rules file, in YAML if
+// the file has a ".yaml" or ".yml" extension and in JSON otherwise
+func LoadRules(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", path, err)
+		}
+	}
+
+	rules := &Rules{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(rules); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules in %s: %s", path, err)
+	}
+
+	return rules, nil
+}
+
+// yamlToJSON will convert a YAML document to JSON, so YAML rules are decoded
+// (and validated) exactly like JSON rules
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonValue(document))
+}
+
+// jsonValue will replace the maps decoded from YAML, which have interface{}
+// keys, with maps JSON can encode
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			result[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return result
+
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonValue(item)
+		}
+		return value
+
+	default:
+		return value
+	}
+}
+
+// Validate will check that the rules would produce a valid Envoy configuration
+func (r *Rules) Validate() error {
+	seen := make(map[string]bool)
+
+	for i, vhost := range r.VirtualHosts {
+		if seen[vhost.Name] {
+			return fmt.Errorf("virtual_hosts[%d]: duplicate virtual host %q", i, vhost.Name)
+		}
+		seen[vhost.Name] = true
+
+		if err := validateVirtualHost(vhost); err != nil {
+			return fmt.Errorf("virtual_hosts[%d]: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateVirtualHost will check that a rules virtual host can be accepted by Envoy
+func validateVirtualHost(vhost RuleVirtualHost) error {
+	if vhost.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+
+	for _, table := range vhost.RouteTables {
+		if strings.TrimSpace(table) == "" {
+			return fmt.Errorf("(%s): empty route table name", vhost.Name)
+		}
+	}
+
+	if vhost.Replace && len(vhost.Routes) == 0 {
+		return fmt.Errorf("(%s): replace requires at least one route", vhost.Name)
+	}
+
+	for i, rule := range vhost.Routes {
+		routes, err := rule.envoyRoutes()
+		if err != nil {
+			return fmt.Errorf("(%s): routes[%d]: %s", vhost.Name, i, err)
+		}
+
+		for _, route := range routes {
+			if err := validateRoute(route); err != nil {
+				return fmt.Errorf("(%s): routes[%d]: %s", vhost.Name, i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply will merge the rules into the generated virtual hosts, keyed by their
+// first domain
+func (r *Rules) apply(vhosts map[string]*VirtualHost) {
+	if r == nil {
+		return
+	}
+
+	byName := make(map[string]*VirtualHost)
+	domains := make(map[string]string)
+	for _, vhost := range vhosts {
+		byName[vhost.Name] = vhost
+		for _, domain := range vhost.Domains {
+			domains[domain] = vhost.Name
+		}
+	}
+
+	for _, rule := range r.VirtualHosts {
+		logger := log.WithField("virtual_host", rule.Name)
+
+		vhost, ok := byName[rule.Name]
+		if !ok && len(rule.Domains) == 0 {
+			logger.Warn("Skipping rules: no such virtual host and no domains declared")
+			continue
+		}
+
+		// Envoy rejects the whole route configuration on duplicate domains
+		if owner, duplicate := duplicateDomain(rule.Domains, domains); duplicate != "" {
+			logger.Warnf("Skipping rules: domain %s is already served by virtual host %s", duplicate, owner)
+			continue
+		}
+
+		if !ok {
+			vhost = &VirtualHost{Name: rule.Name}
+			vhosts[rule.Domains[0]] = vhost
+		}
+
+		for _, domain := range rule.Domains {
+			domains[domain] = rule.Name
+		}
+
+		vhost.Domains = append(vhost.Domains, rule.Domains...)
+		if rule.Replace {
+			vhost.Routes = rule.envoyRoutes()
+		} else {
+			vhost.Routes = append(rule.envoyRoutes(), vhost.Routes...)
+		}
+	}
+}
+
+// duplicateDomain will return the first domain (and its virtual host) that is already in use
+func duplicateDomain(candidates []string, domains map[string]string) (owner, domain string) {
+	for _, domain := range candidates {
+		if owner, ok := domains[domain]; ok {
+			return owner, domain
+		}
+	}
+
+	return "", ""
+}
+
+// validateRoute will check that a route can be accepted by Envoy
+func validateRoute(route Route) error {
+	matchers := 0
+	for _, matcher := range []string{route.Prefix, route.Path, route.Regex} {
+		if matcher != "" {
+			matchers++
+		}
+	}
+
+	if matchers != 1 {
+		return fmt.Errorf("exactly one of prefix, path or regex must be set")
+	}
+
+	if route.Prefix != "" && !strings.HasPrefix(route.Prefix, "/") {
+		return fmt.Errorf("prefix %q must start with /", route.Prefix)
+	}
+
+	if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("path %q must start with /", route.Path)
+	}
+
+	if route.Regex != "" {
+		if _, err := regexp.Compile(route.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %s", err)
+		}
+	}
+
+	redirect := route.HostRedirect != "" || route.PathRedirect != ""
+
+	switch {
+	case redirect && (route.Cluster != "" || route.WeightedClusters != nil):
+		return fmt.Errorf("redirects can not have a cluster or weighted_clusters")
+	case redirect:
+		if err := validateRedirect(route); err != nil {
+			return err
+		}
+	case route.Cluster == "" && route.WeightedClusters == nil:
+		return fmt.Errorf("missing cluster, weighted_clusters or redirect")
+	case route.Cluster != "" && route.WeightedClusters != nil:
+		return fmt.Errorf("cluster and weighted_clusters are mutually exclusive")
+	case route.WeightedClusters != nil:
+		if err := route.WeightedClusters.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if route.HostRewrite != "" && route.AutoHostRewrite {
+		return fmt.Errorf("host_rewrite and auto_host_rewrite are mutually exclusive")
+	}
+
+	if route.PrefixRewrite != "" && route.Regex != "" {
+		return fmt.Errorf("prefix_rewrite requires a prefix or path route")
+	}
+
+	if route.Shadow != nil {
+		if err := validateShadow(*route.Shadow); err != nil {
+			return err
+		}
+	}
+
+	if route.RetryPolicy != nil && route.RetryPolicy.RetryOn == "" {
+		return fmt.Errorf("retry_policy requires retry_on")
+	}
+
+	for _, header := range route.Headers {
+		if header.Name == "" {
+			return fmt.Errorf("header matcher is missing name")
+		}
+
+		if header.Regex {
+			if header.Value == "" {
+				return fmt.Errorf("header matcher %s: regex requires a value", header.Name)
+			}
+			if _, err := regexp.Compile(header.Value); err != nil {
+				return fmt.Errorf("header matcher %s: invalid regex: %s", header.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRedirect will check that a redirect route can be accepted by Envoy,
+// redirects are answered by Envoy and do not forward (or rewrite) the request
+func validateRedirect(route Route) error {
+	if route.PathRedirect != "" && !strings.HasPrefix(route.PathRedirect, "/") {
+		return fmt.Errorf("path_redirect %q must start with /", route.PathRedirect)
+	}
+
+	if route.PrefixRewrite != "" || route.HostRewrite != "" || route.AutoHostRewrite {
+		return fmt.Errorf("redirects can not rewrite the request")
+	}
+
+	if route.Shadow != nil {
+		return fmt.Errorf("redirects can not have a shadow")
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package rds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRules will write a rules file into the directory
+func writeRules(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadRulesYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := writeRules(t, dir, "rules.json", `{
+		"virtual_hosts": [{
+			"name": "api",
+			"domains": ["api.example.com"],
+			"routes": [
+				{"prefix": "/users", "cluster": "api-users", "timeout_ms": 1500, "case_sensitive": false},
+				{"prefix": "/billing", "cluster": "billing", "strip": "/billing", "headers": [{"name": "X-Canary", "value": "yes"}]}
+			]
+		}]
+	}`)
+
+	yamlRules := `
+virtual_hosts:
+  - name: api
+    domains: [api.example.com]
+    routes:
+      - prefix: /users
+        cluster: api-users
+        timeout_ms: 1500
+        case_sensitive: false
+      - prefix: /billing
+        cluster: billing
+        strip: /billing
+        headers:
+          - name: X-Canary
+            value: "yes"
+`
+
+	expected, err := LoadRules(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"rules.yaml", "rules.YML"} {
+		rules, err := LoadRules(writeRules(t, dir, name, yamlRules))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if !reflect.DeepEqual(rules, expected) {
+			t.Errorf("%s: expected the rules of the JSON file %+v, got %+v", name, expected, rules)
+		}
+	}
+
+	// YAML rules are validated like JSON rules
+	invalid := writeRules(t, dir, "invalid.yaml", "virtual_hosts:\n  - name: api\n    routes: []\n    unknown: true\n")
+	if _, err := LoadRules(invalid); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package rds
+
+import "net/http"
+
+// Scoped will return the response with only the routes to clusters allowed by
+// the filter, weighted routes are only allowed if all their clusters are.
+// Routes to other clusters keep their position and are denied, so requests
+// matching them never fall through to a later route. Shadows to other
+// clusters are removed
+func (r Response) Scoped(allows func(cluster string) bool) Response {
+	result := r
+	result.VirtualHosts = make([]VirtualHost, 0, len(r.VirtualHosts))
+
+	for _, vhost := range r.VirtualHosts {
+		routes := make([]Route, 0, len(vhost.Routes))
+		for _, route := range vhost.Routes {
+			// Redirects do not send traffic to a cluster
+			if !allowsAll(route.Clusters(), allows) {
+				routes = append(routes, deniedRoute(route, allows))
+				continue
+			}
+
+			if route.Shadow != nil && !allows(route.Shadow.Cluster) {
+				route.Shadow = nil
+			}
+
+			routes = append(routes, route)
+		}
+
+		vhost.Routes = routes
+		result.VirtualHosts = append(result.VirtualHosts, vhost)
+	}
+
+	return result
+}
+
+// deniedRoute will return a route matching the same requests as the route,
+// answering them with 403 Forbidden. RDS v1 has no direct responses, so the
+// route keeps a disallowed cluster instead: the clusters are scoped too, so
+// Envoy does not know the cluster and fails the request
+func deniedRoute(route Route, allows func(cluster string) bool) Route {
+	denied := Route{
+		Prefix:         route.Prefix,
+		Path:           route.Path,
+		Regex:          route.Regex,
+		CaseSensitive:  route.CaseSensitive,
+		Headers:        route.Headers,
+		DirectResponse: &DirectResponse{Status: http.StatusForbidden},
+	}
+
+	for _, cluster := range route.Clusters() {
+		if !allows(cluster) {
+			denied.Cluster = cluster
+			break
+		}
+	}
+
+	return denied
+}
+
+// allowsAll will return true if the filter allows all clusters
+func allowsAll(clusters []string, allows func(cluster string) bool) bool {
+	for _, cluster := range clusters {
+		if !allows(cluster) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,66 @@
+package rds
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResponseScoped(t *testing.T) {
+	response := Response{VirtualHosts: []VirtualHost{{
+		Name:    "default",
+		Domains: []string{"*"},
+		Routes: []Route{
+			{Prefix: "/billing/admin", Cluster: "billing-admin"},
+			{Prefix: "/billing/new", WeightedClusters: &WeightedClusters{Clusters: []WeightedCluster{
+				{Name: "billing", Weight: 90},
+				{Name: "billing-admin", Weight: 10},
+			}}},
+			{Prefix: "/billing", Cluster: "billing", Shadow: &Shadow{Cluster: "billing-admin"}},
+			{Prefix: "/", Cluster: "web"},
+		},
+	}}}
+
+	allows := func(cluster string) bool { return cluster != "billing-admin" }
+	scoped := response.Scoped(allows)
+
+	tests := []struct {
+		path    string
+		cluster string
+		status  int
+	}{
+		{path: "/billing/admin/users", status: http.StatusForbidden},
+		{path: "/billing/new/invoice", status: http.StatusForbidden},
+		{path: "/billing/invoices", cluster: "billing"},
+		{path: "/", cluster: "web"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			match := scoped.Match(Request{Host: "example.com", Path: test.path})
+			if !match.Matched() {
+				t.Fatal("expected a route to match")
+			}
+
+			if match.Cluster != test.cluster || match.WeightedClusters != nil || match.Status != test.status {
+				t.Errorf("expected cluster %q and status %d, got cluster %q (weighted %v) and status %d", test.cluster, test.status, match.Cluster, match.WeightedClusters, match.Status)
+			}
+
+			if match.Shadow != nil {
+				t.Errorf("expected no shadow to a disallowed cluster, got %v", match.Shadow)
+			}
+		})
+	}
+
+	// RDS v1 has no direct responses, the denied routes keep a cluster the
+	// Envoy node does not know
+	for _, route := range scoped.VirtualHosts[0].Routes[:2] {
+		if route.Cluster != "billing-admin" || route.WeightedClusters != nil {
+			t.Errorf("expected the denied route %s to keep the disallowed cluster, got %q", route.Prefix, route.Cluster)
+		}
+	}
+
+	// The response is not modified
+	if response.VirtualHosts[0].Routes[2].Shadow == nil || response.VirtualHosts[0].Routes[0].DirectResponse != nil {
+		t.Error("expected the scoped response to be a copy")
+	}
+}
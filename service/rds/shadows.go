@@ -0,0 +1,124 @@
+package rds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/kvdoc"
+	"github.com/jippi/consul-envoy/service/tags"
+	log "github.com/sirupsen/logrus"
+)
+
+// shadowsKVPrefix is the Consul KV path (relative to the consul-envoy KV
+// prefix) holding traffic shadows, one per service
+const shadowsKVPrefix = "shadows/"
+
+// validateShadow will check that a shadow can be accepted by Envoy
+func validateShadow(shadow Shadow) error {
+	if shadow.Cluster == "" {
+		return fmt.Errorf("shadow is missing cluster")
+	}
+
+	return nil
+}
+
+// parseShadowTag will parse the value of a "envoy.shadow=<cluster>[:<runtime key>]" tag
+func parseShadowTag(value string) (Shadow, error) {
+	shadow := Shadow{Cluster: value}
+	if i := strings.Index(value, ":"); i != -1 {
+		shadow = Shadow{Cluster: value[:i], RuntimeKey: value[i+1:]}
+	}
+
+	return shadow, validateShadow(shadow)
+}
+
+// validShadows will return the shadow documents from Consul KV, keyed by the
+// cluster they mirror. Invalid shadows are logged and the previous valid
+// shadow for the cluster is kept
+func validShadows(documents, previous map[string][]byte) map[string][]byte {
+	return kvdoc.Parse(documents, previous, shadowsKVPrefix, "shadow", func(_ string, document []byte) error {
+		_, err := parseShadow(document)
+		return err
+	})
+}
+
+// parseShadows will return the traffic shadows of the valid shadow
+// documents, keyed by the cluster they mirror
+func parseShadows(documents map[string][]byte) map[string]Shadow {
+	result := make(map[string]Shadow, len(documents))
+	for cluster, document := range documents {
+		result[cluster], _ = parseShadow(document)
+	}
+
+	return result
+}
+
+// parseShadow will parse and validate a shadow document
+func parseShadow(document []byte) (Shadow, error) {
+	shadow := Shadow{}
+
+	if err := kvdoc.Decode(document, &shadow); err != nil {
+		return shadow, err
+	}
+
+	return shadow, validateShadow(shadow)
+}
+
+// serviceShadows will return the shadow of each service, from its KV shadow
+// document or the "envoy.shadow" tag. Shadows to the service itself or to
+// unknown clusters are ignored
+func serviceShadows(services catalog.Services, documents map[string]Shadow) map[string]Shadow {
+	result := make(map[string]Shadow)
+
+	for name, service := range services {
+		logger := log.WithField("service", name)
+
+		shadow, ok := documents[name]
+		if !ok {
+			value, found := tags.Lookup(service.Tags, nil, "shadow")
+			if !found {
+				continue
+			}
+
+			var err error
+			if shadow, err = parseShadowTag(value); err != nil {
+				logger.Warnf("Ignoring shadow tag: %s", err)
+				continue
+			}
+		}
+
+		if shadow.Cluster == name {
+			logger.Warn("Ignoring shadow: a service can not shadow itself")
+			continue
+		}
+
+		if _, ok := services[shadow.Cluster]; !ok {
+			logger.Warnf("Ignoring shadow: unknown cluster %s", shadow.Cluster)
+			continue
+		}
+
+		result[name] = shadow
+	}
+
+	return result
+}
+
+// applyShadows will mirror the traffic of every route to a shadowed cluster,
+// unless the route already declares its own shadow
+func applyShadows(vhosts map[string]*VirtualHost, shadows map[string]Shadow) {
+	if len(shadows) == 0 {
+		return
+	}
+
+	for _, vhost := range vhosts {
+		for i, route := range vhost.Routes {
+			shadow, ok := shadows[route.Cluster]
+			if !ok || route.Shadow != nil {
+				continue
+			}
+
+			vhost.Routes[i].Shadow = &Shadow{Cluster: shadow.Cluster, RuntimeKey: shadow.RuntimeKey}
+		}
+	}
+}
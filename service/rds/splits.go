@@ -0,0 +1,145 @@
+package rds
+
+import (
+	"fmt"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/kvdoc"
+	log "github.com/sirupsen/logrus"
+)
+
+// splitsKVPrefix is the Consul KV path (relative to the consul-envoy KV
+// prefix) holding traffic splits, one per service
+const splitsKVPrefix = "splits/"
+
+// totalWeight is the sum of the weights of weighted clusters Envoy requires
+const totalWeight = 100
+
+// Clusters will return the clusters the route sends traffic to, none for redirects
+func (r Route) Clusters() []string {
+	if r.WeightedClusters != nil {
+		clusters := make([]string, 0, len(r.WeightedClusters.Clusters))
+		for _, cluster := range r.WeightedClusters.Clusters {
+			clusters = append(clusters, cluster.Name)
+		}
+		return clusters
+	}
+
+	if r.Cluster != "" {
+		return []string{r.Cluster}
+	}
+
+	return nil
+}
+
+// Validate will check that the weighted clusters can be accepted by Envoy
+func (w WeightedClusters) Validate() error {
+	if len(w.Clusters) == 0 {
+		return fmt.Errorf("weighted_clusters requires at least one cluster")
+	}
+
+	total := 0
+	seen := make(map[string]bool)
+	for _, cluster := range w.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("weighted cluster is missing name")
+		}
+
+		if seen[cluster.Name] {
+			return fmt.Errorf("duplicate weighted cluster %q", cluster.Name)
+		}
+		seen[cluster.Name] = true
+
+		if cluster.Weight < 0 || cluster.Weight > totalWeight {
+			return fmt.Errorf("weight of %s must be between 0 and %d", cluster.Name, totalWeight)
+		}
+		total += cluster.Weight
+	}
+
+	if total != totalWeight {
+		return fmt.Errorf("weights must add up to %d, not %d", totalWeight, total)
+	}
+
+	return nil
+}
+
+// validSplits will return the split documents from Consul KV, keyed by the
+// cluster they split. Invalid splits are logged and the previous valid split
+// for the cluster is kept
+func validSplits(documents, previous map[string][]byte) map[string][]byte {
+	return kvdoc.Parse(documents, previous, splitsKVPrefix, "split", func(_ string, document []byte) error {
+		_, err := parseSplit(document)
+		return err
+	})
+}
+
+// parseSplits will return the traffic splits of the valid split documents,
+// keyed by the cluster they split
+func parseSplits(documents map[string][]byte) map[string]WeightedClusters {
+	result := make(map[string]WeightedClusters, len(documents))
+	for cluster, document := range documents {
+		result[cluster], _ = parseSplit(document)
+	}
+
+	return result
+}
+
+// parseSplit will parse and validate a split document
+func parseSplit(document []byte) (WeightedClusters, error) {
+	split := WeightedClusters{}
+
+	if err := kvdoc.Decode(document, &split); err != nil {
+		return split, err
+	}
+
+	return split, split.Validate()
+}
+
+// knownSplits will return the splits whose clusters are all known services,
+// as Envoy would answer requests to an unknown cluster with errors
+func knownSplits(splits map[string]WeightedClusters, services catalog.Services) map[string]WeightedClusters {
+	result := make(map[string]WeightedClusters)
+
+	for name, split := range splits {
+		if _, ok := services[name]; !ok {
+			continue
+		}
+
+		known := true
+		for _, cluster := range split.Clusters {
+			if _, ok := services[cluster.Name]; !ok {
+				log.WithField("cluster", name).Warnf("Ignoring split: unknown cluster %s", cluster.Name)
+				known = false
+				break
+			}
+		}
+
+		if known {
+			result[name] = split
+		}
+	}
+
+	return result
+}
+
+// applySplits will replace the cluster of every route to a split cluster with
+// the weighted clusters of the split
+func applySplits(vhosts map[string]*VirtualHost, splits map[string]WeightedClusters) {
+	if len(splits) == 0 {
+		return
+	}
+
+	for _, vhost := range vhosts {
+		for i, route := range vhost.Routes {
+			split, ok := splits[route.Cluster]
+			if !ok {
+				continue
+			}
+
+			weighted := split
+			weighted.Clusters = append([]WeightedCluster{}, split.Clusters...)
+			vhost.Routes[i].Cluster = ""
+			vhost.Routes[i].WeightedClusters = &weighted
+		}
+	}
+}
@@ -1,6 +1,6 @@
 package rds
 
-import "time"
+import "github.com/jippi/consul-envoy/service/millis"
 
 // Response ...
 // https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/route_config/route_config.html?highlight=virtual_hosts
@@ -50,40 +50,55 @@ type Action struct {
 // Route ...
 // https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/route_config/route#config-http-conn-man-route-table-route
 type Route struct {
-	Prefix              string        `json:"prefix,omitempty"`
-	Path                string        `json:"path,omitempty"`
-	Regex               string        `json:"regex,omitempty"`
-	Cluster             string        `json:"cluster"`
-	HostRedirect        string        `json:"host_redirect,omitempty"`
-	PathRedirect        string        `json:"path_redirect,omitempty"`
-	PrefixRewrite       string        `json:"prefix_rewrite,omitempty"`
-	HostRewrite         string        `json:"host_rewrite,omitempty"`
-	AutoHostRewrite     bool          `json:"auto_host_rewrite,omitempty"`
-	CaseSensitive       bool          `json:"case_sensitive,omitempty"`
-	UseWebsocket        bool          `json:"use_websocket,omitempty"`
-	TimeoutMS           time.Duration `json:"timeout_ms,omitempty"`
-	RetryPolicy         *RetryPolicy  `json:"retry_policy,omitempty"`
-	Shadow              *Shadow       `json:"shadow,omitempty"`
-	Priority            string        `json:"priority,omitempty"`
-	Headers             []Header      `json:"headers,omitempty"`
-	RateLimits          []RateLimit   `json:"rate_limits,omitempty"`
-	IncludeVhRateLimits bool          `json:"include_vh_rate_limits,omitempty"`
-	HashPolicy          *HashPolicy   `json:"hash_policy,omitempty"`
-	Decorator           *Decorator    `json:"decorator,omitempty"`
+	Prefix              string            `json:"prefix,omitempty"`
+	Path                string            `json:"path,omitempty"`
+	Regex               string            `json:"regex,omitempty"`
+	Cluster             string            `json:"cluster,omitempty"`
+	WeightedClusters    *WeightedClusters `json:"weighted_clusters,omitempty"`
+	HostRedirect        string            `json:"host_redirect,omitempty"`
+	PathRedirect        string            `json:"path_redirect,omitempty"`
+	PrefixRewrite       string            `json:"prefix_rewrite,omitempty"`
+	HostRewrite         string            `json:"host_rewrite,omitempty"`
+	AutoHostRewrite     bool              `json:"auto_host_rewrite,omitempty"`
+	CaseSensitive       *bool             `json:"case_sensitive,omitempty"` // Envoy matches case sensitive unless set to false
+	UseWebsocket        bool              `json:"use_websocket,omitempty"`
+	TimeoutMS           millis.Duration   `json:"timeout_ms,omitempty"`
+	RetryPolicy         *RetryPolicy      `json:"retry_policy,omitempty"`
+	Shadow              *Shadow           `json:"shadow,omitempty"`
+	Priority            string            `json:"priority,omitempty"`
+	Headers             []Header          `json:"headers,omitempty"`
+	RateLimits          []RateLimit       `json:"rate_limits,omitempty"`
+	IncludeVhRateLimits bool              `json:"include_vh_rate_limits,omitempty"`
+	HashPolicy          *HashPolicy       `json:"hash_policy,omitempty"`
+	Decorator           *Decorator        `json:"decorator,omitempty"`
+	DirectResponse      *DirectResponse   `json:"-"` // Response sent instead of routing (v2 only), for routes denied by a policy
 	// cors
 	// cluster_header
-	// weighted_clusters
 	// runtime
 	// request_headers_to_add
 	// opaque_config
 }
 
+// WeightedClusters ...
+// https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/route_config/route#weighted-clusters
+type WeightedClusters struct {
+	Clusters         []WeightedCluster `json:"clusters"`
+	RuntimeKeyPrefix string            `json:"runtime_key_prefix,omitempty"`
+}
+
+// WeightedCluster ...
+// https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/route_config/route#weighted-clusters
+type WeightedCluster struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
 // RetryPolicy ...
 // https://www.envoyproxy.io/docs/envoy/v1.6.0/api-v1/route_config/route#config-http-conn-man-route-table-route-retry
 type RetryPolicy struct {
-	RetryOn         string        `json:"retry_on"`
-	NumRetries      int           `json:"num_retries,omitempty"`
-	PerTryTimeoutMS time.Duration `json:"per_try_timeout_ms,omitempty"`
+	RetryOn         string          `json:"retry_on"`
+	NumRetries      int             `json:"num_retries,omitempty"`
+	PerTryTimeoutMS millis.Duration `json:"per_try_timeout_ms,omitempty"`
 }
 
 // Shadow ...
@@ -98,7 +113,7 @@ type Shadow struct {
 type Header struct {
 	Name  string `json:"name"`
 	Value string `json:"value,omitempty"`
-	Regex string `json:"regex,omitempty"`
+	Regex bool   `json:"regex,omitempty"` // Value is a regular expression
 }
 
 // HashPolicy ...
@@ -112,3 +127,10 @@ type HashPolicy struct {
 type Decorator struct {
 	Operation string `json:"operation"`
 }
+
+// DirectResponse is answered by Envoy itself instead of routing the request,
+// RDS v1 has no direct responses
+// https://www.envoyproxy.io/docs/envoy/v1.11.0/api-v2/api/v2/route/route.proto#route-directresponseaction
+type DirectResponse struct {
+	Status int `json:"status"`
+}
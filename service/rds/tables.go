@@ -0,0 +1,110 @@
+package rds
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/tags"
+)
+
+// DefaultRouteTable is the route table services and rules are part of when
+// they do not declare any route tables
+const DefaultRouteTable = "default"
+
+// serviceRouteTables will return the route tables of each service, from the
+// "route_tables" field of its KV route document or the "envoy.route_tables"
+// tag, defaulting to the default route table
+func serviceRouteTables(services catalog.Services, documents map[string]RuleVirtualHost) map[string][]string {
+	tables := make(map[string][]string)
+
+	for name, service := range services {
+		if document, ok := documents[name]; ok && len(document.RouteTables) > 0 {
+			tables[name] = document.RouteTables
+			continue
+		}
+
+		if value, ok := tags.Lookup(service.Tags, nil, "route_tables"); ok {
+			tables[name] = splitRouteTables(value)
+			continue
+		}
+
+		tables[name] = []string{DefaultRouteTable}
+	}
+
+	return tables
+}
+
+// splitRouteTables will split a comma separated list of route tables
+func splitRouteTables(value string) []string {
+	tables := make([]string, 0)
+	for _, table := range strings.Split(value, ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			tables = append(tables, table)
+		}
+	}
+
+	if len(tables) == 0 {
+		return []string{DefaultRouteTable}
+	}
+
+	return tables
+}
+
+// routeTableNames will return the names of all route tables used by services
+// and rules, always including the default route table
+func routeTableNames(serviceTables map[string][]string, rules ...*Rules) []string {
+	seen := map[string]bool{DefaultRouteTable: true}
+
+	for _, tables := range serviceTables {
+		for _, table := range tables {
+			seen[table] = true
+		}
+	}
+
+	for _, r := range rules {
+		if r == nil {
+			continue
+		}
+
+		for _, vhost := range r.VirtualHosts {
+			for _, table := range vhost.RouteTables {
+				seen[table] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// forTable will return the rules for the virtual hosts in the route table.
+// Virtual hosts without route tables extending a service follow the route
+// tables of the service, others are part of the default route table
+func (r *Rules) forTable(table string, serviceTables map[string][]string) *Rules {
+	if r == nil {
+		return nil
+	}
+
+	result := &Rules{}
+	for _, vhost := range r.VirtualHosts {
+		tables := vhost.RouteTables
+		if len(tables) == 0 {
+			tables = serviceTables[vhost.Name]
+		}
+		if len(tables) == 0 {
+			tables = []string{DefaultRouteTable}
+		}
+
+		if tags.Has(tables, table) {
+			result.VirtualHosts = append(result.VirtualHosts, vhost)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,247 @@
+package rds
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jippi/consul-envoy/service/millis"
+)
+
+// routeTagPrefix is the prefix for fabio-style route tags, e.g.
+// "envoy-route=api.example.com/users strip=/users timeout=10s retries=2"
+const routeTagPrefix = "envoy-route="
+
+// tagRoute is a route parsed from a service route tag
+type tagRoute struct {
+	Host  string // Host the route applies to, empty for all hosts
+	Route Route  // The Envoy route
+}
+
+// defaultRoute will return the route used for a service when nothing else is configured
+func defaultRoute(cluster, prefix string) Route {
+	return Route{
+		Cluster:   cluster,
+		Prefix:    prefix,
+		TimeoutMS: millis.Duration(3 * time.Minute),
+		RetryPolicy: &RetryPolicy{
+			RetryOn:    "5xx,connect-failure",
+			NumRetries: 1,
+		},
+	}
+}
+
+// parseRouteTags will parse all route tags for a service, skipping tags that
+// are not route tags
+func parseRouteTags(service string, tags []string) ([]tagRoute, []error) {
+	routes := make([]tagRoute, 0)
+	errors := make([]error, 0)
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, routeTagPrefix) {
+			continue
+		}
+
+		parsed, err := parseRouteTag(service, strings.TrimPrefix(tag, routeTagPrefix))
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid route tag %q: %s", tag, err))
+			continue
+		}
+
+		routes = append(routes, parsed...)
+	}
+
+	return routes, errors
+}
+
+// parseRouteTag will parse the value of a single route tag, which results in
+// two routes when stripping the whole prefix (see stripPrefix)
+func parseRouteTag(service, value string) ([]tagRoute, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing host/path")
+	}
+
+	host, path := fields[0], "/"
+	if i := strings.Index(fields[0], "/"); i != -1 {
+		host, path = fields[0][:i], fields[0][i:]
+	}
+
+	route := defaultRoute(service, path)
+	strip := ""
+
+	for _, option := range fields[1:] {
+		key, value := option, ""
+		if i := strings.Index(option, "="); i != -1 {
+			key, value = option[:i], option[i+1:]
+		}
+
+		// The prefix is stripped once all options are applied, as it may
+		// split the route in two
+		if key == "strip" {
+			strip = value
+			continue
+		}
+
+		if err := applyRouteOption(&route, key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Redirects are answered by Envoy, without forwarding to the service
+	if route.HostRedirect != "" || route.PathRedirect != "" {
+		route.Cluster = ""
+		route.TimeoutMS = 0
+		route.RetryPolicy = nil
+	}
+
+	routes := []Route{route}
+	if strip != "" {
+		if route.PrefixRewrite != "" {
+			return nil, fmt.Errorf("strip and prefix_rewrite are mutually exclusive")
+		}
+
+		var err error
+		if routes, err = stripPrefix(route, strip); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]tagRoute, 0, len(routes))
+	for _, r := range routes {
+		if err := validateRoute(r); err != nil {
+			return nil, err
+		}
+
+		result = append(result, tagRoute{Host: host, Route: r})
+	}
+
+	return result, nil
+}
+
+// stripPrefix will return the prefix or path route rewritten to remove the
+// prefix before forwarding the request.
+//
+// Envoy replaces the matched prefix with the rewrite, so a prefix route
+// stripped of its whole prefix (e.g. "/users" stripped of "/users") would
+// forward "/users/1" as "//1" and match "/usersettings". Such routes are split
+// into a "/users/" prefix route and a "/users" path route, both rewritten to "/"
+func stripPrefix(route Route, prefix string) ([]Route, error) {
+	matched := route.Prefix
+	if matched == "" {
+		matched = route.Path
+	}
+
+	if matched == "" || !strings.HasPrefix(matched, prefix) {
+		return nil, fmt.Errorf("strip %q is not a prefix of %q", prefix, matched)
+	}
+
+	rest := strings.TrimPrefix(matched, prefix)
+	route.PrefixRewrite = "/" + strings.TrimLeft(rest, "/")
+
+	if route.Prefix == "" || rest != "" || strings.HasSuffix(route.Prefix, "/") {
+		return []Route{route}, nil
+	}
+
+	exact := route
+	exact.Prefix, exact.Path = "", route.Prefix
+	route.Prefix += "/"
+
+	return []Route{route, exact}, nil
+}
+
+// applyRouteOption will apply a single "key=value" route tag option to the route
+func applyRouteOption(route *Route, key, value string) error {
+	switch key {
+	case "prefix_rewrite":
+		route.PrefixRewrite = value
+
+	case "host_rewrite":
+		route.HostRewrite = value
+
+	case "auto_host_rewrite":
+		route.AutoHostRewrite = true
+
+	case "host_redirect":
+		route.HostRedirect = value
+
+	case "path_redirect":
+		route.PathRedirect = value
+
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %s", err)
+		}
+		route.TimeoutMS = millis.Duration(timeout)
+
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid retries %q", value)
+		}
+		if retries == 0 {
+			route.RetryPolicy = nil
+			return nil
+		}
+		if route.RetryPolicy == nil {
+			route.RetryPolicy = &RetryPolicy{RetryOn: "5xx,connect-failure"}
+		}
+		route.RetryPolicy.NumRetries = retries
+
+	case "retry_on":
+		if route.RetryPolicy == nil {
+			return fmt.Errorf("retry_on requires retries to be enabled")
+		}
+		route.RetryPolicy.RetryOn = value
+
+	case "websocket":
+		route.UseWebsocket = true
+
+	case "shadow":
+		shadow, err := parseShadowTag(value)
+		if err != nil {
+			return err
+		}
+		route.Shadow = &shadow
+
+	case "header", "header_regex":
+		header, err := parseHeaderOption(value, key == "header_regex")
+		if err != nil {
+			return err
+		}
+		route.Headers = append(route.Headers, header)
+
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+
+	return nil
+}
+
+// parseHeaderOption will parse a "name:value" header option into a header
+// matcher, a header without value matches any request with the header
+func parseHeaderOption(value string, regex bool) (Header, error) {
+	name, match := value, ""
+	if i := strings.Index(value, ":"); i != -1 {
+		name, match = value[:i], value[i+1:]
+	}
+
+	if name == "" {
+		return Header{}, fmt.Errorf("header %q is missing name", value)
+	}
+
+	header := Header{Name: strings.ToLower(name), Value: match, Regex: regex}
+	if regex {
+		if match == "" {
+			return Header{}, fmt.Errorf("header_regex %q is missing a regex", value)
+		}
+		if _, err := regexp.Compile(match); err != nil {
+			return Header{}, fmt.Errorf("header_regex %q: %s", value, err)
+		}
+	}
+
+	return header, nil
+}
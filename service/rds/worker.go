@@ -2,27 +2,48 @@ package rds
 
 import (
 	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/notify"
+	"github.com/jippi/consul-envoy/service/tags"
 	log "github.com/sirupsen/logrus"
 )
 
 // Worker for RDS (Route Discovery Service)
 type Worker struct {
-	consul       *api.Client              // Consul API client
-	consulDomain string                   // Consul domain
-	serviceCh    chan map[string][]string // Consul services channel (with tags)
-	stopCh       chan interface{}         // Stop channel
-	response     Response                 // Pre-computed response for HTTP server
+	consul       *api.Client            // Consul API client
+	consulDomain string                 // Consul domain
+	config       Config                 // RDS configuration
+	serviceCh    chan catalog.Services  // Consul services channel (with tags)
+	kvCh         chan map[string][]byte // Consul KV documents channel
+	rulesCh      chan *Rules            // Reloaded routing rules channel
+	stopCh       chan interface{}       // Stop channel
+	responses    map[string]Response    // Pre-computed responses for HTTP server, keyed by route table
+	updates      notify.Notifier        // Notifies subscribers about new responses
+}
+
+// Config for the RDS worker
+type Config struct {
+	RulesFile string // Path to the routing rules file, reloaded on change
+	Rules     *Rules // Routing rules loaded from RulesFile at startup
 }
 
 // NewWorker will return the struct for a RDS worker
-func NewWorker(consul *api.Client, consulDomain string, serviceCh chan map[string][]string) *Worker {
+func NewWorker(consul *api.Client, consulDomain string, serviceCh chan catalog.Services, kvCh chan map[string][]byte, config Config) *Worker {
 	return &Worker{
 		consul:       consul,
 		consulDomain: consulDomain,
+		config:       config,
 		serviceCh:    serviceCh,
+		kvCh:         kvCh,
+		rulesCh:      make(chan *Rules),
 		stopCh:       make(chan interface{}),
 	}
 }
@@ -30,46 +51,87 @@ func NewWorker(consul *api.Client, consulDomain string, serviceCh chan map[strin
 // Start will start the RDS worker, listening for service channel changes
 // and pre-build RDS HTTP response
 func (w *Worker) Start() {
+	if w.config.RulesFile != "" {
+		go w.watchRules()
+	}
+
+	var services catalog.Services
+	rules := w.config.Rules
+	documents := make(map[string][]byte)
+	splits := make(map[string][]byte)
+	shadows := make(map[string][]byte)
+
 	for {
 		select {
 		case <-w.stopCh:
 			return
 
-		case services := <-w.serviceCh:
+		case services = <-w.serviceCh:
 			log.Info("Got services")
 
-			vhosts := make([]VirtualHost, 0)
-
-			for name := range services {
-				vhost := VirtualHost{
-					Name: name,
-					Domains: []string{
-						fmt.Sprintf("%s.service.%s", name, w.consulDomain),
-					},
-					Routes: []Route{
-						Route{
-							Cluster:   name,
-							Prefix:    "/",
-							TimeoutMS: 3 * time.Minute,
-							RetryPolicy: &RetryPolicy{
-								RetryOn:    "5xx,connect-failure",
-								NumRetries: 1,
-							},
-						},
-					},
-				}
+		case kv := <-w.kvCh:
+			log.Info("Got KV documents")
+			documents = validDocuments(kv, documents)
+			splits = validSplits(kv, splits)
+			shadows = validShadows(kv, shadows)
 
-				if _, ok := services["api-users"]; ok && name == "api" {
-					vhost.Routes = append([]Route{{Cluster: "api-users", Prefix: "/users", RetryPolicy: vhost.Routes[0].RetryPolicy}}, vhost.Routes...)
-					vhost.Routes = append([]Route{{Cluster: "api-users", Prefix: "/oauth", RetryPolicy: vhost.Routes[0].RetryPolicy}}, vhost.Routes...)
-					vhost.Routes = append([]Route{{Cluster: "api-users", Prefix: "/me", RetryPolicy: vhost.Routes[0].RetryPolicy}}, vhost.Routes...)
-					vhost.Routes = append([]Route{{Cluster: "api-users", Prefix: "/emails", RetryPolicy: vhost.Routes[0].RetryPolicy}}, vhost.Routes...)
-				}
+		case rules = <-w.rulesCh:
+			log.Info("Got routing rules")
+		}
+
+		responses := buildResponses(services, w.consulDomain, rules, parseDocuments(documents), parseSplits(splits), parseShadows(shadows))
+		if reflect.DeepEqual(responses, w.responses) {
+			log.Debug("Routes did not change")
+			continue
+		}
+
+		w.responses = responses
+		w.updates.Notify()
+	}
+}
+
+// watchRules will reload the routing rules file when it changes, keeping the
+// last valid rules if the file is invalid
+func (w *Worker) watchRules() {
+	logger := log.WithField("rules_file", w.config.RulesFile)
 
-				vhosts = append(vhosts, vhost)
+	var lastModified time.Time
+	if info, err := os.Stat(w.config.RulesFile); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+
+		case <-ticker.C:
+			info, err := os.Stat(w.config.RulesFile)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+
+			if info.ModTime().Equal(lastModified) {
+				continue
 			}
+			lastModified = info.ModTime()
 
-			w.response = Response{VirtualHosts: vhosts}
+			rules, err := LoadRules(w.config.RulesFile)
+			if err != nil {
+				logger.Errorf("Keeping previous routing rules: %s", err)
+				continue
+			}
+
+			logger.Info("Reloaded routing rules")
+			select {
+			case w.rulesCh <- rules:
+			case <-w.stopCh:
+				return
+			}
 		}
 	}
 }
@@ -79,7 +141,261 @@ func (w *Worker) Stop() {
 	close(w.stopCh)
 }
 
-// Response will return the pre-computed RDS response
-func (w *Worker) Response() Response {
-	return w.response
+// Subscribe will return a channel notified each time the RDS response changes
+func (w *Worker) Subscribe() <-chan struct{} {
+	return w.updates.Subscribe()
+}
+
+// Response will return the pre-computed RDS response for a route table
+func (w *Worker) Response(routeTable string) (Response, bool) {
+	response, ok := w.responses[routeTable]
+	return response, ok
+}
+
+// Responses will return the pre-computed RDS responses, keyed by route table
+func (w *Worker) Responses() map[string]Response {
+	return w.responses
+}
+
+// Build will build the RDS response of each route table for the services, as
+// the worker does with the routing rules and the KV documents (keyed relative
+// to the KV prefix)
+func Build(services catalog.Services, consulDomain string, rules *Rules, kv map[string][]byte) map[string]Response {
+	return buildResponses(services, consulDomain, rules, parseDocuments(validDocuments(kv, nil)), parseSplits(validSplits(kv, nil)), parseShadows(validShadows(kv, nil)))
+}
+
+// buildResponses will build the RDS response of each route table, from the
+// services, routing rules, KV route documents, KV splits and shadows in the
+// route table
+func buildResponses(services catalog.Services, consulDomain string, rules *Rules, documents map[string]RuleVirtualHost, splits map[string]WeightedClusters, shadows map[string]Shadow) map[string]Response {
+	serviceTables := serviceRouteTables(services, documents)
+	docs := documentRules(documents)
+	splits = knownSplits(splits, services)
+	shadows = serviceShadows(services, shadows)
+
+	responses := make(map[string]Response)
+	for _, table := range routeTableNames(serviceTables, rules, docs) {
+		tableServices := make(catalog.Services)
+		for name, service := range services {
+			if tags.Has(serviceTables[name], table) {
+				tableServices[name] = service
+			}
+		}
+
+		responses[table] = buildResponse(tableServices, consulDomain, rules.forTable(table, serviceTables), docs.forTable(table, serviceTables), splits, shadows)
+	}
+
+	return responses
+}
+
+// buildResponse will build the RDS response for the Consul services, with a
+// virtual host per service and datacenter, a virtual host per host found in
+// route tags, the routing rules and KV route documents merged in, the routes
+// to shadowed clusters mirrored and the routes to split clusters sent to their
+// weighted clusters
+func buildResponse(services catalog.Services, consulDomain string, rules, documents *Rules, splits map[string]WeightedClusters, shadows map[string]Shadow) Response {
+	vhosts := make(map[string]*VirtualHost)
+	byDomain := make(map[string]*VirtualHost)
+	tagRoutes := make(map[string][]Route)
+
+	for name, service := range services {
+		vhost := &VirtualHost{
+			Name:    name,
+			Domains: serviceDomains(service, consulDomain),
+			Routes: []Route{
+				defaultRoute(name, "/"),
+			},
+		}
+
+		vhosts[vhost.Domains[0]] = vhost
+		for _, domain := range vhost.Domains {
+			byDomain[domain] = vhost
+		}
+
+		// Route tags are only used in the local datacenter, as the same
+		// service in other datacenters (or its subsets) would claim the same hosts
+		if !service.Local || service.Subset != "" {
+			continue
+		}
+
+		routes, errors := parseRouteTags(name, service.Tags)
+		for _, err := range errors {
+			log.WithField("service", name).Warn(err)
+		}
+
+		for _, route := range routes {
+			host := route.Host
+			if host == "" {
+				host = "*"
+			}
+
+			tagRoutes[host] = append(tagRoutes[host], route.Route)
+		}
+	}
+
+	// Envoy rejects duplicate domains, so routes for a host that is already
+	// served by a service virtual host are placed in front of its routes
+	for host, routes := range tagRoutes {
+		sortRoutes(routes)
+
+		vhost, ok := byDomain[host]
+		if !ok {
+			vhost = &VirtualHost{
+				Name:    tagHostName(host),
+				Domains: []string{host},
+			}
+			vhosts[host] = vhost
+		}
+
+		vhost.Routes = append(routes, vhost.Routes...)
+	}
+
+	rules.apply(vhosts)
+	documents.apply(vhosts)
+	applyShadows(vhosts, shadows)
+	applySplits(vhosts, splits)
+
+	for _, vhost := range vhosts {
+		vhost.Routes = orderHeaderRoutes(vhost.Routes)
+	}
+
+	return Response{VirtualHosts: sortVirtualHosts(vhosts)}
+}
+
+// serviceDomains will return the Consul DNS names for a service, services in
+// the local datacenter can be reached both with and without the datacenter.
+// Subsets use the Consul DNS tag lookup, e.g. "v2.api.service.consul"
+func serviceDomains(service catalog.Service, consulDomain string) []string {
+	if service.Query {
+		return []string{fmt.Sprintf("%s.query.%s", service.Name, consulDomain)}
+	}
+
+	name := service.Name
+	if service.Subset != "" {
+		name = service.Subset + "." + name
+	}
+
+	domains := make([]string, 0, 2)
+	if service.Local {
+		domains = append(domains, fmt.Sprintf("%s.service.%s", name, consulDomain))
+	}
+
+	return append(domains, fmt.Sprintf("%s.service.%s.%s", name, service.Datacenter, consulDomain))
+}
+
+// sortVirtualHosts will return the virtual hosts ordered by name
+func sortVirtualHosts(vhosts map[string]*VirtualHost) []VirtualHost {
+	result := make([]VirtualHost, 0, len(vhosts))
+	for _, vhost := range vhosts {
+		result = append(result, *vhost)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// tagHostName will return the virtual host name for a host from route tags
+func tagHostName(host string) string {
+	if host == "*" {
+		return "default"
+	}
+
+	return host
+}
+
+// sortRoutes will order routes so the most specific prefix or path is matched
+// first, and for the same prefix the routes matching the most headers, as Envoy
+// uses the first route that matches
+func sortRoutes(routes []Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		li, lj := len(routes[i].Prefix)+len(routes[i].Path), len(routes[j].Prefix)+len(routes[j].Path)
+		if li != lj {
+			return li > lj
+		}
+
+		// Exact paths are more specific than prefixes of the same length
+		if (routes[i].Path != "") != (routes[j].Path != "") {
+			return routes[i].Path != ""
+		}
+
+		if len(routes[i].Headers) != len(routes[j].Headers) {
+			return len(routes[i].Headers) > len(routes[j].Headers)
+		}
+
+		return routes[i].Cluster < routes[j].Cluster
+	})
+}
+
+// orderHeaderRoutes will move every route matching headers in front of the
+// first route without header matchers that would otherwise match all of its
+// requests (e.g. the catch-all "/" route), keeping the order of all other routes
+func orderHeaderRoutes(routes []Route) []Route {
+	result := make([]Route, 0, len(routes))
+
+	for _, route := range routes {
+		position := len(result)
+		if len(route.Headers) > 0 {
+			for i, previous := range result {
+				if covers(previous, route) {
+					position = i
+					break
+				}
+			}
+		}
+
+		result = append(result, Route{})
+		copy(result[position+1:], result[position:])
+		result[position] = route
+	}
+
+	return result
+}
+
+// covers will return true if the route without header matchers matches every
+// path the other route matches. A regex route is covered by the catch-all "/"
+// prefix and by prefixes of the literal prefix of the regex, and only covers
+// the exact paths it matches
+func covers(route, other Route) bool {
+	if len(route.Headers) > 0 {
+		return false
+	}
+
+	switch {
+	case route.Prefix != "":
+		if route.Prefix == "/" {
+			return true
+		}
+
+		return strings.HasPrefix(literalPrefix(other), route.Prefix)
+	case route.Path != "":
+		return other.Path == route.Path
+	case route.Regex != "" && other.Path != "":
+		re, err := regexp.Compile("^(?:" + route.Regex + ")$")
+		return err == nil && re.MatchString(other.Path)
+	default:
+		return false
+	}
+}
+
+// literalPrefix will return the prefix shared by every path the route matches
+func literalPrefix(route Route) string {
+	switch {
+	case route.Prefix != "":
+		return route.Prefix
+	case route.Path != "":
+		return route.Path
+	case route.Regex != "":
+		re, err := regexp.Compile(route.Regex)
+		if err != nil {
+			return ""
+		}
+
+		prefix, _ := re.LiteralPrefix()
+		return prefix
+	default:
+		return ""
+	}
 }
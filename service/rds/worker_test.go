@@ -0,0 +1,101 @@
+package rds
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOrderHeaderRoutes(t *testing.T) {
+	canary := []Header{{Name: "X-Canary", Value: "yes"}}
+
+	tests := []struct {
+		name     string
+		routes   []Route
+		expected []string
+	}{
+		{
+			name: "header route behind the catch-all",
+			routes: []Route{
+				{Prefix: "/", Cluster: "web"},
+				{Prefix: "/api", Cluster: "api-canary", Headers: canary},
+			},
+			expected: []string{"api-canary", "web"},
+		},
+		{
+			name: "regex header route behind a prefix of its literal prefix",
+			routes: []Route{
+				{Prefix: "/api", Cluster: "api"},
+				{Prefix: "/apx", Cluster: "apx"},
+				{Regex: "/api/v[0-9]+/users", Cluster: "users-canary", Headers: canary},
+			},
+			expected: []string{"users-canary", "api", "apx"},
+		},
+		{
+			name: "regex header route not covered by an unrelated prefix",
+			routes: []Route{
+				{Prefix: "/apx", Cluster: "apx"},
+				{Regex: "/api/v[0-9]+/users", Cluster: "users-canary", Headers: canary},
+			},
+			expected: []string{"apx", "users-canary"},
+		},
+		{
+			name: "header route stays behind a more specific route",
+			routes: []Route{
+				{Prefix: "/api/admin", Cluster: "admin"},
+				{Path: "/api/health", Cluster: "health"},
+				{Prefix: "/", Cluster: "web"},
+				{Prefix: "/api", Cluster: "api-canary", Headers: canary},
+			},
+			expected: []string{"admin", "health", "api-canary", "web"},
+		},
+		{
+			name: "header routes do not cover each other",
+			routes: []Route{
+				{Prefix: "/", Cluster: "web-canary", Headers: canary},
+				{Prefix: "/api", Cluster: "api-canary", Headers: canary},
+			},
+			expected: []string{"web-canary", "api-canary"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clusters := make([]string, 0)
+			for _, route := range orderHeaderRoutes(test.routes) {
+				clusters = append(clusters, route.Cluster)
+			}
+
+			if !reflect.DeepEqual(clusters, test.expected) {
+				t.Errorf("expected routes to %v, got %v", test.expected, clusters)
+			}
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    Route
+		other    Route
+		expected bool
+	}{
+		{name: "catch-all covers a regex", route: Route{Prefix: "/"}, other: Route{Regex: "[a-z]+/users"}, expected: true},
+		{name: "prefix covers a longer prefix", route: Route{Prefix: "/api"}, other: Route{Prefix: "/api/users"}, expected: true},
+		{name: "prefix covers a regex under it", route: Route{Prefix: "/api/"}, other: Route{Regex: "/api/v[0-9]+"}, expected: true},
+		{name: "prefix does not cover a regex beyond its literal prefix", route: Route{Prefix: "/api/v1"}, other: Route{Regex: "/api/v[0-9]+"}},
+		{name: "longer prefix does not cover a shorter one", route: Route{Prefix: "/api/users"}, other: Route{Prefix: "/api"}},
+		{name: "path covers the same path", route: Route{Path: "/health"}, other: Route{Path: "/health"}, expected: true},
+		{name: "path does not cover a prefix", route: Route{Path: "/health"}, other: Route{Prefix: "/health"}},
+		{name: "regex covers a path it matches", route: Route{Regex: "/orders/[0-9]+"}, other: Route{Path: "/orders/42"}, expected: true},
+		{name: "regex does not cover a prefix", route: Route{Regex: "/orders/.*"}, other: Route{Prefix: "/orders/"}},
+		{name: "header route covers nothing", route: Route{Prefix: "/", Headers: []Header{{Name: "X-Canary"}}}, other: Route{Prefix: "/api"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if covers(test.route, test.other) != test.expected {
+				t.Errorf("expected covers to be %v", test.expected)
+			}
+		})
+	}
+}
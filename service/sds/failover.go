@@ -0,0 +1,132 @@
+package sds
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/cds"
+	log "github.com/sirupsen/logrus"
+)
+
+// FailoverPolicy decides which remote datacenters are used when a service
+// has no eligible instances in the local datacenter
+type FailoverPolicy struct {
+	Datacenters []string // Ordered list of datacenters to fail over to
+	NearestN    int      // Fail over to the N nearest datacenters, by Consul round trip time
+}
+
+// Enabled will return true if the failover policy has any datacenters to fail over to
+func (p FailoverPolicy) Enabled() bool {
+	return len(p.Datacenters) > 0 || p.NearestN > 0
+}
+
+// ParseFailoverPolicy will parse a failover policy, either a comma separated
+// list of datacenters (e.g. "dc2,dc3") or "nearest:<n>"
+func ParseFailoverPolicy(value string) (FailoverPolicy, error) {
+	if strings.HasPrefix(value, "nearest:") {
+		n, err := strconv.Atoi(strings.TrimPrefix(value, "nearest:"))
+		if err != nil || n < 1 {
+			return FailoverPolicy{}, fmt.Errorf("invalid failover policy %q (nearest:<n> requires n >= 1)", value)
+		}
+
+		return FailoverPolicy{NearestN: n}, nil
+	}
+
+	policy := FailoverPolicy{}
+	for _, dc := range strings.Split(value, ",") {
+		if dc = strings.TrimSpace(dc); dc != "" {
+			policy.Datacenters = append(policy.Datacenters, dc)
+		}
+	}
+
+	if !policy.Enabled() {
+		return FailoverPolicy{}, fmt.Errorf("invalid failover policy %q", value)
+	}
+
+	return policy, nil
+}
+
+// failoverDatacenters will return the datacenters to try, in order
+func (c *serviceBuilder) failoverDatacenters(policy FailoverPolicy) ([]string, error) {
+	if policy.NearestN == 0 {
+		return policy.Datacenters, nil
+	}
+
+	// Datacenters are sorted by estimated round trip time from the local agent
+	datacenters, err := c.client.Catalog().Datacenters()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, policy.NearestN)
+	for _, dc := range datacenters {
+		if dc == c.dc {
+			continue
+		}
+
+		if len(result) == policy.NearestN {
+			break
+		}
+
+		result = append(result, dc)
+	}
+
+	return result, nil
+}
+
+// failoverHosts will return the eligible hosts from the first failover
+// datacenter that has any, marked with their datacenter so they can be told
+// apart from local hosts
+func (c *serviceBuilder) failoverHosts(health HealthPolicy) (string, []cds.Host, error) {
+	datacenters, err := c.failoverDatacenters(c.worker.config.Failover)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, dc := range datacenters {
+		q := &api.QueryOptions{AllowStale: true, Datacenter: dc}
+		entries, _, err := c.client.Health().Service(c.service, c.subset, false, q)
+		if err != nil {
+			log.WithField("cluster", c.cluster).Errorf("Could not read service health in %s: %s", dc, err)
+			continue
+		}
+
+		hosts := buildHosts(entries, health, c.worker.config)
+		if len(hosts) == 0 {
+			continue
+		}
+
+		for i := range hosts {
+			hosts[i].Datacenter = dc
+		}
+
+		return dc, hosts, nil
+	}
+
+	return "", nil, nil
+}
+
+// failoverZones will return the hosts with the datacenter of failover hosts as
+// availability zone. SDS v1 has no priorities, so the zone is the only way to
+// tell failover hosts apart, while xDS puts them in a lower priority instead
+func failoverZones(hosts []cds.Host) []cds.Host {
+	result := make([]cds.Host, 0, len(hosts))
+
+	for _, host := range hosts {
+		if host.Datacenter != "" {
+			tags := cds.HostTags{}
+			if host.Tags != nil {
+				tags = *host.Tags
+			}
+
+			tags.AZ = host.Datacenter
+			host.Tags = &tags
+		}
+
+		result = append(result, host)
+	}
+
+	return result
+}
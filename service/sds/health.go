@@ -0,0 +1,43 @@
+package sds
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// HealthPolicy decides which service instances are eligible for the SDS host list
+type HealthPolicy string
+
+const (
+	// HealthPassing only allows instances where all checks are passing
+	HealthPassing HealthPolicy = "passing"
+
+	// HealthWarning allows instances where all checks are passing or warning
+	HealthWarning HealthPolicy = "warning"
+
+	// HealthAny allows all instances, regardless of their check status
+	HealthAny HealthPolicy = "any"
+)
+
+// ParseHealthPolicy will parse and validate a health policy
+func ParseHealthPolicy(value string) (HealthPolicy, error) {
+	switch policy := HealthPolicy(value); policy {
+	case HealthPassing, HealthWarning, HealthAny:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid health policy %q (must be one of passing, warning or any)", value)
+	}
+}
+
+// Allows will return true if the instance is eligible under the health policy
+func (p HealthPolicy) Allows(entry *api.ServiceEntry) bool {
+	switch entry.Checks.AggregatedStatus() {
+	case api.HealthPassing:
+		return true
+	case api.HealthWarning:
+		return p == HealthWarning || p == HealthAny
+	default:
+		return p == HealthAny
+	}
+}
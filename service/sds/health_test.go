@@ -0,0 +1,165 @@
+package sds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeConsul will serve the instances of each service from
+// /v1/health/service/<service>, the server must be closed by the caller
+func fakeConsul(t *testing.T, services map[string][]*api.ServiceEntry) (*api.Client, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		entries, ok := services[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+		if !ok {
+			entries = []*api.ServiceEntry{}
+		}
+
+		w.Header().Set("X-Consul-Index", "1")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		w.Header().Set("X-Consul-LastContact", "0")
+		json.NewEncoder(w).Encode(entries)
+	}))
+
+	client, err := api.NewClient(&api.Config{Address: server.URL})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+// instance will return a service entry with a check in each of the statuses
+func instance(address string, statuses ...string) *api.ServiceEntry {
+	entry := &api.ServiceEntry{
+		Node:    &api.Node{Node: "node-" + address, Address: address},
+		Service: &api.AgentService{Service: "api", Address: address, Port: 8080},
+	}
+
+	for _, status := range statuses {
+		entry.Checks = append(entry.Checks, &api.HealthCheck{Status: status})
+	}
+
+	return entry
+}
+
+// readHosts will read the instances of the api service from Consul and build
+// the SDS hosts, like the service builder does
+func readHosts(t *testing.T, client *api.Client, serviceTags []string, config Config) []string {
+	entries, _, err := client.Health().Service("api", "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := healthPolicy(config.HealthPolicy, serviceTags, log.WithField("service", "api"))
+
+	ips := make([]string, 0)
+	for _, host := range buildHosts(entries, policy, config) {
+		ips = append(ips, host.IP)
+	}
+	sort.Strings(ips)
+
+	return ips
+}
+
+func TestBuildHostsHealthPolicy(t *testing.T) {
+	client, server := fakeConsul(t, map[string][]*api.ServiceEntry{
+		"api": {
+			instance("10.0.0.1", api.HealthPassing, api.HealthPassing),
+			instance("10.0.0.2", api.HealthPassing, api.HealthWarning),
+			instance("10.0.0.3", api.HealthWarning, api.HealthCritical),
+			instance("10.0.0.4", api.HealthCritical),
+		},
+	})
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		policy      HealthPolicy
+		serviceTags []string
+		expected    []string
+	}{
+		{
+			name:     "passing",
+			policy:   HealthPassing,
+			expected: []string{"10.0.0.1"},
+		},
+		{
+			name:     "warning",
+			policy:   HealthWarning,
+			expected: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:     "any",
+			policy:   HealthAny,
+			expected: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		},
+		{
+			name:        "tag overrides policy",
+			policy:      HealthPassing,
+			serviceTags: []string{"envoy.health=warning"},
+			expected:    []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:        "tag allows all instances",
+			policy:      HealthPassing,
+			serviceTags: []string{"envoy.health=any"},
+			expected:    []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		},
+		{
+			name:        "invalid tag keeps policy",
+			policy:      HealthWarning,
+			serviceTags: []string{"envoy.health=sometimes"},
+			expected:    []string{"10.0.0.1", "10.0.0.2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{HealthPolicy: test.policy, AZSources: DefaultAZSources}
+
+			hosts := readHosts(t, client, test.serviceTags, config)
+			if !reflect.DeepEqual(hosts, test.expected) {
+				t.Errorf("expected hosts %v, got %v", test.expected, hosts)
+			}
+		})
+	}
+}
+
+func TestBuildHostsWithoutChecks(t *testing.T) {
+	client, server := fakeConsul(t, map[string][]*api.ServiceEntry{
+		"api": {instance("10.0.0.1")},
+	})
+	defer server.Close()
+
+	// Consul reports instances without checks as passing
+	hosts := readHosts(t, client, nil, Config{HealthPolicy: HealthPassing})
+	if !reflect.DeepEqual(hosts, []string{"10.0.0.1"}) {
+		t.Errorf("expected the instance without checks, got %v", hosts)
+	}
+}
+
+func TestParseHealthPolicy(t *testing.T) {
+	for _, value := range []string{"passing", "warning", "any"} {
+		if policy, err := ParseHealthPolicy(value); err != nil || string(policy) != value {
+			t.Errorf("ParseHealthPolicy(%q) = %q, %v", value, policy, err)
+		}
+	}
+
+	if _, err := ParseHealthPolicy("critical"); err == nil {
+		t.Error("expected an error for an invalid health policy")
+	}
+}
@@ -0,0 +1,82 @@
+package sds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// AZSource is a source for the availability zone of a service instance
+type AZSource struct {
+	Kind  string // One of "node-meta", "service-meta", "datacenter" or "static"
+	Value string // Meta key for "node-meta" and "service-meta", the zone for "static"
+}
+
+// DefaultAZSources are used when no availability zone sources are configured
+var DefaultAZSources = []AZSource{{Kind: "node-meta", Value: "aws_instance_availability-zone"}}
+
+// ParseAZSources will parse a comma separated list of availability zone
+// sources, e.g. "node-meta:zone,service-meta:zone,datacenter,static:eu-west-1a"
+func ParseAZSources(value string) ([]AZSource, error) {
+	sources := make([]AZSource, 0)
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		kind, arg := item, ""
+		if i := strings.Index(item, ":"); i != -1 {
+			kind, arg = item[:i], item[i+1:]
+		}
+
+		switch kind {
+		case "node-meta", "service-meta", "static":
+			if arg == "" {
+				return nil, fmt.Errorf("availability zone source %q requires a value (%s:<value>)", kind, kind)
+			}
+
+		case "datacenter":
+			if arg != "" {
+				return nil, fmt.Errorf("availability zone source %q does not take a value", kind)
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown availability zone source %q", kind)
+		}
+
+		sources = append(sources, AZSource{Kind: kind, Value: arg})
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no availability zone sources configured")
+	}
+
+	return sources, nil
+}
+
+// resolveAZ will return the availability zone from the first source that has a value
+func resolveAZ(sources []AZSource, entry *api.ServiceEntry) string {
+	for _, source := range sources {
+		var zone string
+
+		switch source.Kind {
+		case "node-meta":
+			zone = entry.Node.Meta[source.Value]
+		case "service-meta":
+			zone = entry.Service.Meta[source.Value]
+		case "datacenter":
+			zone = entry.Node.Datacenter
+		case "static":
+			zone = source.Value
+		}
+
+		if zone != "" {
+			return zone
+		}
+	}
+
+	return ""
+}
@@ -3,10 +3,12 @@ package sds
 import (
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/jippi/consul-envoy/service/cds"
+	"github.com/jippi/consul-envoy/service/tags"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,19 +16,48 @@ type serviceBuilder struct {
 	lastSeen time.Time
 	closeCh  chan interface{}
 	client   *api.Client
-	service  string
+	cluster  string // Envoy cluster name, used as key for the SDS response
+	service  string // Consul service name
+	dc       string // Consul datacenter
+	local    bool   // True if dc is the local datacenter
+	query    bool   // True if service is a prepared query
+	subset   string // Service tag the instances must have, empty for all instances
 	worker   *Worker
+
+	tagsLock sync.Mutex
+	tags     []string // Consul service tags, updated by the worker
+}
+
+func (c *serviceBuilder) setTags(tags []string) {
+	c.tagsLock.Lock()
+	defer c.tagsLock.Unlock()
+	c.tags = tags
+}
+
+func (c *serviceBuilder) getTags() []string {
+	c.tagsLock.Lock()
+	defer c.tagsLock.Unlock()
+	return c.tags
 }
 
 func (c *serviceBuilder) work() {
+	if c.query {
+		c.workQuery()
+		return
+	}
+
 	q := &api.QueryOptions{
 		AllowStale: true,
+		Datacenter: c.dc,
 		WaitIndex:  0,
 		WaitTime:   jitter(5 * time.Minute),
 	}
 
-	defer c.worker.response.Delete(c.service)
-	logger := log.WithField("service", c.service)
+	defer c.worker.delete(c.cluster)
+	logger := log.WithField("cluster", c.cluster)
+
+	failover := c.local && c.worker.config.Failover.Enabled()
+	failingOver := false
 
 	for {
 		select {
@@ -36,14 +67,16 @@ func (c *serviceBuilder) work() {
 
 		default:
 			logger.Info("Reading service health")
-			backends, meta, err := c.client.Catalog().Service(c.service, "", q)
+			entries, meta, err := c.client.Health().Service(c.service, c.subset, false, q)
 			if err != nil {
 				logger.Error(err)
 				time.Sleep(jitter(5 * time.Second))
 				continue
 			}
 
-			if q.WaitIndex == meta.LastIndex {
+			// Remote instances are not watched, so they are refreshed on every
+			// (shorter) query while failing over
+			if q.WaitIndex == meta.LastIndex && !failingOver {
 				logger.Infof("Read service health (but no changes)")
 				continue
 			}
@@ -51,38 +84,163 @@ func (c *serviceBuilder) work() {
 
 			q.WaitIndex = meta.LastIndex
 
-			hosts := make([]cds.Host, 0)
-			for _, entry := range backends {
-				if ip := net.ParseIP(entry.Address); ip != nil {
-					hosts = append(hosts, cds.Host{
-						IP:   entry.ServiceAddress,
-						Port: entry.ServicePort,
-						Tags: &cds.HostTags{
-							AZ: entry.NodeMeta["aws_instance_availability-zone"],
-						},
-					})
-					continue
-				}
+			policy := healthPolicy(c.worker.config.HealthPolicy, c.getTags(), logger)
+			hosts := buildHosts(entries, policy, c.worker.config)
 
-				ips, err := net.LookupIP(entry.Address)
+			if failover && len(hosts) == 0 {
+				dc, remote, err := c.failoverHosts(policy)
 				if err != nil {
-					continue
+					logger.Errorf("Could not fail over: %s", err)
 				}
 
-				for _, ip := range ips {
-					hosts = append(hosts, cds.Host{
-						IP:   ip.String(),
-						Port: entry.ServicePort,
-						Tags: &cds.HostTags{
-							AZ: entry.NodeMeta["aws_instance_availability-zone"],
-						},
-					})
+				if len(remote) > 0 {
+					if !failingOver {
+						logger.Warnf("No eligible local instances, failing over to %s", dc)
+					}
+					failingOver = true
+					q.WaitTime = jitter(30 * time.Second)
+					hosts = remote
 				}
+			} else if failingOver {
+				logger.Info("Eligible local instances are back, stopped failing over")
+				failingOver = false
+				q.WaitTime = jitter(5 * time.Minute)
+			}
+
+			c.worker.store(c.cluster, Response{Hosts: hosts})
+		}
+	}
+}
+
+// workQuery will periodically execute the prepared query, as prepared
+// queries do not support blocking queries
+func (c *serviceBuilder) workQuery() {
+	defer c.worker.delete(c.cluster)
+	logger := log.WithField("cluster", c.cluster)
+
+	for {
+		logger.Info("Executing prepared query")
+		result, _, err := c.client.PreparedQuery().Execute(c.service, &api.QueryOptions{AllowStale: true})
+		if err != nil {
+			logger.Error(err)
+		} else {
+			entries := make([]*api.ServiceEntry, 0, len(result.Nodes))
+			for i := range result.Nodes {
+				entries = append(entries, &result.Nodes[i])
 			}
 
-			c.worker.response.Store(c.service, Response{Hosts: hosts})
+			policy := healthPolicy(c.worker.config.HealthPolicy, c.getTags(), logger)
+			c.worker.store(c.cluster, Response{Hosts: buildHosts(entries, policy, c.worker.config)})
 		}
+
+		select {
+		case <-c.closeCh:
+			logger.Info("Shutting down builder")
+			return
+
+		case <-time.After(jitter(30 * time.Second)):
+		}
+	}
+}
+
+// Build will build the SDS response for the instances of a service, as the
+// service builder does for a service in the local datacenter
+func Build(entries []*api.ServiceEntry, serviceTags []string, config Config) Response {
+	logger := log.WithField("service", "")
+	if len(entries) > 0 {
+		logger = log.WithField("service", entries[0].Service.Service)
 	}
+
+	policy := healthPolicy(config.HealthPolicy, serviceTags, logger)
+	return Response{Hosts: buildHosts(entries, policy, config)}
+}
+
+// healthPolicy will return the health policy for a service, allowing the
+// default policy to be overridden with the "envoy.health" service tag
+func healthPolicy(fallback HealthPolicy, serviceTags []string, logger *log.Entry) HealthPolicy {
+	value, ok := tags.Lookup(serviceTags, nil, "health")
+	if !ok {
+		return fallback
+	}
+
+	policy, err := ParseHealthPolicy(value)
+	if err != nil {
+		logger.Warnf("Ignoring service tag: %s", err)
+		return fallback
+	}
+
+	return policy
+}
+
+// buildHosts will convert the Consul service entries eligible under the
+// health policy to SDS hosts, leaving out the instances with a weight of 0
+func buildHosts(entries []*api.ServiceEntry, policy HealthPolicy, config Config) []cds.Host {
+	hosts := make([]cds.Host, 0)
+
+	eligible := make([]*api.ServiceEntry, 0, len(entries))
+	weights := make([]int, 0, len(entries))
+
+	for _, entry := range entries {
+		if !policy.Allows(entry) {
+			continue
+		}
+
+		weight, err := resolveWeight(entry)
+		if err != nil {
+			log.WithField("service", entry.Service.Service).Warnf("Instance %s: %s", entry.Service.ID, err)
+		}
+
+		if weight == 0 {
+			log.WithField("service", entry.Service.Service).Debugf("Instance %s excluded by its weight of 0", entry.Service.ID)
+			continue
+		}
+
+		eligible = append(eligible, entry)
+		weights = append(weights, weight)
+	}
+
+	if !scaleWeights(weights) {
+		log.WithField("service", eligible[0].Service.Service).Warnf("Instance weights raised to the minimum of %d, the load balancing ratio differs from Consul", minWeight)
+	}
+
+	for i, entry := range eligible {
+		hostTags := &cds.HostTags{
+			AZ:                  resolveAZ(config.AZSources, entry),
+			Canary:              config.CanaryTag != "" && tags.Has(entry.Service.Tags, config.CanaryTag),
+			LoadBalancingWeight: weights[i],
+		}
+
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		if ip := net.ParseIP(address); ip != nil {
+			hosts = append(hosts, cds.Host{
+				IP:   ip.String(),
+				Port: entry.Service.Port,
+				Tags: hostTags,
+				Node: entry.Node.Node,
+			})
+			continue
+		}
+
+		ips, err := net.LookupIP(address)
+		if err != nil {
+			continue
+		}
+
+		for _, ip := range ips {
+			hosts = append(hosts, cds.Host{
+				IP:   ip.String(),
+				Port: entry.Service.Port,
+				Tags: hostTags,
+				Node: entry.Node.Node,
+			})
+		}
+	}
+
+	return hosts
 }
 
 func jitter(d time.Duration) time.Duration {
@@ -0,0 +1,99 @@
+package sds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jippi/consul-envoy/service/cds"
+)
+
+// SidecarMode decides how hosts on the Consul node of the requesting Envoy
+// are preferred over hosts on other nodes
+type SidecarMode string
+
+const (
+	// SidecarOff treats all hosts equally, regardless of the requesting Envoy
+	SidecarOff SidecarMode = ""
+
+	// SidecarLocalFirst prefers hosts on the node of the Envoy, falling back
+	// to the other hosts when there are none
+	SidecarLocalFirst SidecarMode = "local-first"
+
+	// SidecarLocalOnly only uses hosts on the node of the Envoy
+	SidecarLocalOnly SidecarMode = "local-only"
+)
+
+// nodeSeparator separates the cluster and the Envoy node in the SDS service
+// name of clusters served in sidecar mode, e.g. "api@node-1"
+const nodeSeparator = "@"
+
+// ParseSidecarMode will parse and validate a sidecar mode
+func ParseSidecarMode(value string) (SidecarMode, error) {
+	switch mode := SidecarMode(value); mode {
+	case SidecarOff, SidecarLocalFirst, SidecarLocalOnly:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid sidecar mode %q (must be one of local-first or local-only)", value)
+	}
+}
+
+// Enabled will return true if hosts depend on the node of the Envoy
+func (m SidecarMode) Enabled() bool {
+	return m != SidecarOff
+}
+
+// Priorities will group the hosts by priority as seen from an Envoy on the
+// node, empty groups are left out
+func (m SidecarMode) Priorities(hosts []cds.Host, node string) [][]cds.Host {
+	if !m.Enabled() {
+		return [][]cds.Host{hosts}
+	}
+
+	local := make([]cds.Host, 0)
+	remote := make([]cds.Host, 0)
+	for _, host := range hosts {
+		if host.Node == node {
+			local = append(local, host)
+		} else {
+			remote = append(remote, host)
+		}
+	}
+
+	priorities := make([][]cds.Host, 0, 2)
+	if len(local) > 0 {
+		priorities = append(priorities, local)
+	}
+	if m == SidecarLocalFirst && len(remote) > 0 {
+		priorities = append(priorities, remote)
+	}
+
+	return priorities
+}
+
+// Hosts will return the hosts used by an Envoy on the node, SDS v1 has no
+// priorities so only the first priority is used
+func (m SidecarMode) Hosts(hosts []cds.Host, node string) []cds.Host {
+	priorities := m.Priorities(hosts, node)
+	if len(priorities) == 0 {
+		return make([]cds.Host, 0)
+	}
+
+	return priorities[0]
+}
+
+// SidecarServiceName will return the SDS service name of a cluster for an
+// Envoy on the node
+func SidecarServiceName(cluster, node string) string {
+	return cluster + nodeSeparator + node
+}
+
+// ParseServiceName will split a SDS service name in the cluster and the
+// Envoy node, the node is empty for clusters not served in sidecar mode
+func ParseServiceName(serviceName string) (cluster, node string) {
+	i := strings.LastIndex(serviceName, nodeSeparator)
+	if i == -1 {
+		return serviceName, ""
+	}
+
+	return serviceName[:i], serviceName[i+1:]
+}
@@ -0,0 +1,80 @@
+package sds
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/tags"
+)
+
+const (
+	minWeight = 1   // Minimum load balancing weight accepted by Envoy
+	maxWeight = 100 // Maximum load balancing weight accepted by Envoy
+)
+
+// resolveWeight will return the load balancing weight for a service instance,
+// before it is scaled into the range accepted by Envoy (see scaleWeights).
+// A weight of 0 excludes the instance.
+//
+// The "envoy.weight" service meta key takes precedence, otherwise the Consul
+// service weight matching the instance health status is used
+func resolveWeight(entry *api.ServiceEntry) (int, error) {
+	if value, ok := tags.Lookup(nil, entry.Service.Meta, "weight"); ok {
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 || weight > maxWeight {
+			return consulWeight(entry), fmt.Errorf("invalid weight %q in service meta (must be between 0 and %d)", value, maxWeight)
+		}
+
+		return weight, nil
+	}
+
+	return consulWeight(entry), nil
+}
+
+// consulWeight will return the Consul service weight for the instance health
+// status. Consul requires a passing weight of at least 1, so a passing weight
+// of 0 means the weights are unset (Consul before 1.2.3) and 1 is used
+func consulWeight(entry *api.ServiceEntry) int {
+	if entry.Service.Weights.Passing == 0 {
+		return 1
+	}
+
+	if entry.Checks.AggregatedStatus() == api.HealthWarning {
+		return entry.Service.Weights.Warning
+	}
+
+	return entry.Service.Weights.Passing
+}
+
+// scaleWeights will scale the weights of the instances of a service
+// proportionally into the range accepted by Envoy, so Consul weights above
+// the maximum keep their ratio (e.g. 1000 and 250 become 100 and 25).
+//
+// Weights below the minimum are raised to it, in which case false is
+// returned as the ratio between the instances changed
+func scaleWeights(weights []int) bool {
+	highest := 0
+	for _, weight := range weights {
+		if weight > highest {
+			highest = weight
+		}
+	}
+
+	kept := true
+	for i, weight := range weights {
+		if highest > maxWeight {
+			weight = int(math.Round(float64(weight) * maxWeight / float64(highest)))
+		}
+
+		if weight < minWeight {
+			weight = minWeight
+			kept = false
+		}
+
+		weights[i] = weight
+	}
+
+	return kept
+}
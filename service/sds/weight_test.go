@@ -0,0 +1,71 @@
+package sds
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// weighted will return a service entry with the Consul weights and service meta
+func weighted(address string, weights api.AgentWeights, meta map[string]string, statuses ...string) *api.ServiceEntry {
+	entry := instance(address, statuses...)
+	entry.Service.Weights = weights
+	entry.Service.Meta = meta
+
+	return entry
+}
+
+func TestBuildHostsZeroWeight(t *testing.T) {
+	client, server := fakeConsul(t, map[string][]*api.ServiceEntry{
+		"api": {
+			weighted("10.0.0.1", api.AgentWeights{Passing: 10, Warning: 1}, nil, api.HealthPassing),
+			weighted("10.0.0.2", api.AgentWeights{Passing: 10, Warning: 1}, map[string]string{"envoy_weight": "0"}, api.HealthPassing),
+			weighted("10.0.0.3", api.AgentWeights{Passing: 10, Warning: 0}, nil, api.HealthWarning),
+			weighted("10.0.0.4", api.AgentWeights{Passing: 10, Warning: 0}, map[string]string{"envoy_weight": "5"}, api.HealthWarning),
+			weighted("10.0.0.5", api.AgentWeights{}, nil, api.HealthWarning),
+		},
+	})
+	defer server.Close()
+
+	// Weights of 0 exclude the instance, from the service meta or the Consul
+	// weights, unless the Consul weights are unset
+	hosts := readHosts(t, client, nil, Config{HealthPolicy: HealthWarning})
+	expected := []string{"10.0.0.1", "10.0.0.4", "10.0.0.5"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected hosts %v, got %v", expected, hosts)
+	}
+}
+
+func TestResolveWeight(t *testing.T) {
+	tests := []struct {
+		name     string
+		weights  api.AgentWeights
+		meta     map[string]string
+		status   string
+		expected int
+		invalid  bool
+	}{
+		{name: "passing", weights: api.AgentWeights{Passing: 10, Warning: 1}, status: api.HealthPassing, expected: 10},
+		{name: "warning", weights: api.AgentWeights{Passing: 10, Warning: 1}, status: api.HealthWarning, expected: 1},
+		{name: "warning excluded", weights: api.AgentWeights{Passing: 10, Warning: 0}, status: api.HealthWarning, expected: 0},
+		{name: "unset weights", status: api.HealthWarning, expected: 1},
+		{name: "meta", weights: api.AgentWeights{Passing: 10}, meta: map[string]string{"envoy_weight": "50"}, status: api.HealthPassing, expected: 50},
+		{name: "meta excluded", weights: api.AgentWeights{Passing: 10}, meta: map[string]string{"envoy_weight": "0"}, status: api.HealthPassing, expected: 0},
+		{name: "meta negative", weights: api.AgentWeights{Passing: 10}, meta: map[string]string{"envoy_weight": "-1"}, status: api.HealthPassing, expected: 10, invalid: true},
+		{name: "meta too high", weights: api.AgentWeights{Passing: 10}, meta: map[string]string{"envoy_weight": "101"}, status: api.HealthPassing, expected: 10, invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			weight, err := resolveWeight(weighted("10.0.0.1", test.weights, test.meta, test.status))
+			if weight != test.expected {
+				t.Errorf("expected weight %d, got %d", test.expected, weight)
+			}
+
+			if (err != nil) != test.invalid {
+				t.Errorf("expected invalid %v, got error %v", test.invalid, err)
+			}
+		})
+	}
+}
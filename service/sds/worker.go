@@ -1,25 +1,41 @@
 package sds
 
 import (
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/jippi/consul-envoy/service/catalog"
+	"github.com/jippi/consul-envoy/service/cds"
+	"github.com/jippi/consul-envoy/service/notify"
 	log "github.com/sirupsen/logrus"
 )
 
 // Worker for SDS (Service Discovery Service)
 type Worker struct {
-	consul    *api.Client              // Consul API Client
-	response  sync.Map                 // Map of pre-computed SDS responses, one per cluster
-	serviceCh chan map[string][]string // Consul services channel (with tags)
-	stopCh    chan interface{}         // Stop channel
+	consul    *api.Client           // Consul API Client
+	config    Config                // SDS configuration
+	response  sync.Map              // Map of pre-computed SDS responses, one per cluster
+	serviceCh chan catalog.Services // Consul services channel (with tags)
+	stopCh    chan interface{}      // Stop channel
+	updates   notify.Notifier       // Notifies subscribers about new responses
+}
+
+// Config for the SDS worker
+type Config struct {
+	HealthPolicy HealthPolicy   // Default health policy, can be overridden per service with the "envoy.health" tag
+	AZSources    []AZSource     // Sources for the host availability zone, first match wins
+	CanaryTag    string         // Service tag marking an instance as canary
+	Failover     FailoverPolicy // Remote datacenters used when a local service has no eligible instances
+	Sidecar      SidecarMode    // Preference for hosts on the node of the requesting Envoy
 }
 
 // NewWorker will return the struct for a SDS worker
-func NewWorker(client *api.Client, serviceCh chan map[string][]string) *Worker {
+func NewWorker(client *api.Client, serviceCh chan catalog.Services, config Config) *Worker {
 	return &Worker{
 		consul:    client,
+		config:    config,
 		serviceCh: serviceCh,
 		stopCh:    make(chan interface{}),
 	}
@@ -52,7 +68,13 @@ func (w *Worker) Start() {
 			}
 
 		case services := <-w.serviceCh:
-			for name := range services {
+			// Without services no response will ever be stored, so tell the
+			// subscribers the (empty) responses are complete
+			if len(services) == 0 {
+				w.updates.Notify()
+			}
+
+			for name, service := range services {
 				if _, ok := running[name]; !ok {
 					log.Infof("Discovered new service %s", name)
 
@@ -60,14 +82,21 @@ func (w *Worker) Start() {
 						lastSeen: time.Now(),
 						closeCh:  make(chan interface{}),
 						client:   w.consul,
-						service:  name,
+						cluster:  name,
+						service:  service.Name,
+						dc:       service.Datacenter,
+						local:    service.Local,
+						query:    service.Query,
+						subset:   service.Subset,
 						worker:   w,
+						tags:     service.Tags,
 					}
 
 					go running[name].work()
 				}
 
 				running[name].lastSeen = time.Now()
+				running[name].setTags(service.Tags)
 			}
 		}
 	}
@@ -78,7 +107,80 @@ func (w *Worker) Stop() {
 	close(w.stopCh)
 }
 
-// Response will return the pre-computed SDS response for a specific service
-func (w *Worker) Response(service string) (value interface{}, ok bool) {
-	return w.response.Load(service)
+// Subscribe will return a channel notified each time a SDS response changes
+func (w *Worker) Subscribe() <-chan struct{} {
+	return w.updates.Subscribe()
+}
+
+// Response will return the pre-computed SDS response for a SDS service name,
+// limited to the hosts used by the Envoy node in the name in sidecar mode and
+// with failover hosts in the availability zone of their datacenter
+func (w *Worker) Response(serviceName string) (Response, bool) {
+	cluster, node := serviceName, ""
+	if w.config.Sidecar.Enabled() {
+		cluster, node = ParseServiceName(serviceName)
+	}
+
+	value, ok := w.response.Load(cluster)
+	if !ok {
+		return Response{}, false
+	}
+
+	response := value.(Response)
+	if node != "" {
+		response = Response{Hosts: w.config.Sidecar.Hosts(response.Hosts, node)}
+	}
+
+	return Response{Hosts: failoverZones(response.Hosts)}, true
+}
+
+// NodeHosts will return the hosts of a cluster on a Consul node
+func (w *Worker) NodeHosts(cluster, node string) []cds.Host {
+	hosts := make([]cds.Host, 0)
+
+	value, ok := w.response.Load(cluster)
+	if !ok {
+		return hosts
+	}
+
+	for _, host := range value.(Response).Hosts {
+		if host.Node == node {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// Sidecar will return the sidecar mode of the SDS worker
+func (w *Worker) Sidecar() SidecarMode {
+	return w.config.Sidecar
+}
+
+// Responses will return all pre-computed SDS responses, keyed by service
+func (w *Worker) Responses() map[string]Response {
+	responses := make(map[string]Response)
+	w.response.Range(func(key, value interface{}) bool {
+		responses[key.(string)] = value.(Response)
+		return true
+	})
+
+	return responses
+}
+
+// store will save the SDS response for a service and notify subscribers, if
+// the response changed
+func (w *Worker) store(service string, response Response) {
+	if previous, ok := w.response.Load(service); ok && reflect.DeepEqual(previous, response) {
+		return
+	}
+
+	w.response.Store(service, response)
+	w.updates.Notify()
+}
+
+// delete will remove the SDS response for a service and notify subscribers
+func (w *Worker) delete(service string) {
+	w.response.Delete(service)
+	w.updates.Notify()
 }
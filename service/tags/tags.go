@@ -0,0 +1,41 @@
+package tags
+
+import "strings"
+
+// Prefix used by all consul-envoy service tags and service meta keys
+const Prefix = "envoy."
+
+// Lookup will return the value for an option configured through Consul,
+// either as a "envoy.<key>=<value>" service tag or as a service meta key.
+//
+// Consul only allows alphanumeric, "-" and "_" characters in meta keys, so the
+// key is also looked up with all "." replaced by "_" (e.g. "envoy_outlier_consecutive_5xx")
+func Lookup(tags []string, meta map[string]string, key string) (string, bool) {
+	if value, ok := meta[Prefix+key]; ok {
+		return value, true
+	}
+
+	if value, ok := meta[strings.Replace(Prefix+key, ".", "_", -1)]; ok {
+		return value, true
+	}
+
+	needle := Prefix + key + "="
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, needle) {
+			return strings.TrimPrefix(tag, needle), true
+		}
+	}
+
+	return "", false
+}
+
+// Has will return true if the tag is present in the list of tags
+func Has(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
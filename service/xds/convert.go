@@ -0,0 +1,406 @@
+package xds
+
+import (
+	"sort"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/jippi/consul-envoy/service/cds"
+	"github.com/jippi/consul-envoy/service/millis"
+	"github.com/jippi/consul-envoy/service/rds"
+	log "github.com/sirupsen/logrus"
+)
+
+// lbPolicies maps the v1 load balancer types to v2 load balancer policies
+var lbPolicies = map[string]v2.Cluster_LbPolicy{
+	"round_robin":     v2.Cluster_ROUND_ROBIN,
+	"least_request":   v2.Cluster_LEAST_REQUEST,
+	"random":          v2.Cluster_RANDOM,
+	"ring_hash":       v2.Cluster_RING_HASH,
+	"original_dst_lb": v2.Cluster_ORIGINAL_DST_LB,
+}
+
+// adsConfigSource makes Envoy fetch resources over the aggregated discovery service
+var adsConfigSource = &core.ConfigSource{
+	ConfigSourceSpecifier: &core.ConfigSource_Ads{
+		Ads: &core.AggregatedConfigSource{},
+	},
+}
+
+// convertCluster will convert a CDS v1 cluster to a v2 cluster, SDS clusters
+// become EDS clusters and static clusters get their hosts inline
+func convertCluster(c cds.Cluster) *v2.Cluster {
+	result := &v2.Cluster{
+		Name:                          c.Name,
+		LbPolicy:                      lbPolicies[c.LBtype],
+		ConnectTimeout:                durationProto(c.ConnectTimeoutMS),
+		MaxRequestsPerConnection:      uint32Value(c.MaxRequestsPerConnection),
+		PerConnectionBufferLimitBytes: uint32Value(c.PerConnectionBufferLimitBytes),
+	}
+
+	if c.Type == "static" {
+		result.ClusterDiscoveryType = &v2.Cluster_Type{Type: v2.Cluster_STATIC}
+		result.LoadAssignment = convertStaticHosts(c.Name, c.Hosts)
+	} else {
+		result.ClusterDiscoveryType = &v2.Cluster_Type{Type: v2.Cluster_EDS}
+		result.EdsClusterConfig = &v2.Cluster_EdsClusterConfig{
+			EdsConfig:   adsConfigSource,
+			ServiceName: c.ServiceName,
+		}
+	}
+
+	if od := c.OutlierDetection; od != nil {
+		result.OutlierDetection = &cluster.OutlierDetection{
+			Consecutive_5Xx:                    uint32Value(od.Consecutive5xx),
+			ConsecutiveGatewayFailure:          uint32Value(od.ConsecutiveGatewayFailure),
+			Interval:                           durationProto(od.IntervalMS),
+			BaseEjectionTime:                   durationProto(od.BaseJjectionTimeMS),
+			MaxEjectionPercent:                 percentValue(od.MaxEjectionPercent),
+			EnforcingConsecutive_5Xx:           percentValue(od.EnforcingConsecutive5xx),
+			EnforcingConsecutiveGatewayFailure: percentValue(od.EnforcingConsecutiveGatewayFailure),
+			EnforcingSuccessRate:               percentValue(od.EnforcingSuccessRate),
+			SuccessRateMinimumHosts:            uint32Value(od.SuccessRateMinimumHosts),
+			SuccessRateRequestVolume:           uint32Value(od.SuccessRateRequestVolume),
+			SuccessRateStdevFactor:             uint32Value(od.SuccessRateStdevFactor),
+		}
+	}
+
+	return result
+}
+
+// convertEndpoints will convert the SDS v1 hosts of a cluster, grouped by
+// priority, to a v2 load assignment with an endpoint group per availability
+// zone and priority
+func convertEndpoints(name string, priorities [][]cds.Host) *v2.ClusterLoadAssignment {
+	result := &v2.ClusterLoadAssignment{ClusterName: name}
+
+	priorities = failoverPriorities(priorities)
+
+	for priority, hosts := range priorities {
+		// Priorities must be contiguous, so an empty priority in front of the
+		// failover hosts is sent as a locality without endpoints
+		if len(hosts) == 0 {
+			if priority < len(priorities)-1 {
+				result.Endpoints = append(result.Endpoints, &endpoint.LocalityLbEndpoints{Priority: uint32(priority)})
+			}
+			continue
+		}
+
+		localities := make(map[string]*endpoint.LocalityLbEndpoints)
+		zones := make([]string, 0)
+
+		for _, host := range hosts {
+			zone := ""
+			if host.Tags != nil {
+				zone = host.Tags.AZ
+			}
+
+			locality, ok := localities[zone]
+			if !ok {
+				locality = &endpoint.LocalityLbEndpoints{
+					Locality: &core.Locality{Zone: zone},
+					Priority: uint32(priority),
+				}
+				localities[zone] = locality
+				zones = append(zones, zone)
+			}
+
+			locality.LbEndpoints = append(locality.LbEndpoints, convertHost(host))
+		}
+
+		sort.Strings(zones)
+
+		for _, zone := range zones {
+			result.Endpoints = append(result.Endpoints, localities[zone])
+		}
+	}
+
+	return result
+}
+
+// failoverPriorities will move the failover hosts from remote datacenters to a
+// priority below all local hosts, so Envoy only uses them while no local host
+// is available
+func failoverPriorities(priorities [][]cds.Host) [][]cds.Host {
+	result := make([][]cds.Host, 0, len(priorities)+1)
+	failover := make([]cds.Host, 0)
+
+	for _, hosts := range priorities {
+		local := make([]cds.Host, 0, len(hosts))
+		for _, host := range hosts {
+			if host.Datacenter != "" {
+				failover = append(failover, host)
+			} else {
+				local = append(local, host)
+			}
+		}
+
+		result = append(result, local)
+	}
+
+	if len(failover) == 0 {
+		return priorities
+	}
+
+	return append(result, failover)
+}
+
+// convertStaticHosts will convert the hosts of a static v1 cluster to a v2
+// load assignment, invalid hosts are logged and skipped
+func convertStaticHosts(name string, hosts []cds.URLHost) *v2.ClusterLoadAssignment {
+	endpoints := &endpoint.LocalityLbEndpoints{}
+
+	for _, host := range hosts {
+		ip, port, err := parseAddress(host.URL)
+		if err != nil {
+			log.WithField("cluster", name).Errorf("Skipping host %s: %s", host.URL, err)
+			continue
+		}
+
+		endpoints.LbEndpoints = append(endpoints.LbEndpoints, convertHost(cds.Host{IP: ip, Port: port}))
+	}
+
+	return &v2.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   []*endpoint.LocalityLbEndpoints{endpoints},
+	}
+}
+
+// convertHost will convert a SDS v1 host to a v2 endpoint
+func convertHost(host cds.Host) *endpoint.LbEndpoint {
+	result := &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: socketAddress(host.IP, host.Port),
+			},
+		},
+	}
+
+	if host.Tags == nil {
+		return result
+	}
+
+	result.LoadBalancingWeight = uint32Value(host.Tags.LoadBalancingWeight)
+
+	if host.Tags.Canary {
+		result.Metadata = &core.Metadata{
+			FilterMetadata: map[string]*structpb.Struct{
+				"envoy.lb": {
+					Fields: map[string]*structpb.Value{
+						"canary": {Kind: &structpb.Value_BoolValue{BoolValue: true}},
+					},
+				},
+			},
+		}
+	}
+
+	return result
+}
+
+// convertRouteConfiguration will convert a RDS v1 response to a v2 route configuration
+func convertRouteConfiguration(name string, response rds.Response) *v2.RouteConfiguration {
+	result := &v2.RouteConfiguration{
+		Name:                    name,
+		ValidateClusters:        &wrappers.BoolValue{Value: response.ValidateClusters},
+		InternalOnlyHeaders:     response.InternalOnlyHeaders,
+		ResponseHeadersToRemove: response.ResponseHeadersToRemove,
+	}
+
+	for _, vhost := range response.VirtualHosts {
+		result.VirtualHosts = append(result.VirtualHosts, convertVirtualHost(vhost))
+	}
+
+	return result
+}
+
+// convertVirtualHost will convert a RDS v1 virtual host to a v2 virtual host
+func convertVirtualHost(vhost rds.VirtualHost) *route.VirtualHost {
+	result := &route.VirtualHost{
+		Name:    vhost.Name,
+		Domains: vhost.Domains,
+	}
+
+	switch vhost.RequireSSL {
+	case "all":
+		result.RequireTls = route.VirtualHost_ALL
+	case "external_only":
+		result.RequireTls = route.VirtualHost_EXTERNAL_ONLY
+	}
+
+	for _, r := range vhost.Routes {
+		result.Routes = append(result.Routes, convertRoute(r))
+	}
+
+	return result
+}
+
+// convertRoute will convert a RDS v1 route to a v2 route
+func convertRoute(r rds.Route) *route.Route {
+	match := &route.RouteMatch{}
+
+	// Left unset, Envoy matches case sensitive like RDS v1 does
+	if r.CaseSensitive != nil {
+		match.CaseSensitive = &wrappers.BoolValue{Value: *r.CaseSensitive}
+	}
+
+	switch {
+	case r.Path != "":
+		match.PathSpecifier = &route.RouteMatch_Path{Path: r.Path}
+	case r.Regex != "":
+		match.PathSpecifier = &route.RouteMatch_Regex{Regex: r.Regex}
+	default:
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: r.Prefix}
+	}
+
+	for _, header := range r.Headers {
+		matcher := &route.HeaderMatcher{Name: header.Name}
+		switch {
+		case header.Regex:
+			matcher.HeaderMatchSpecifier = &route.HeaderMatcher_RegexMatch{RegexMatch: header.Value}
+		case header.Value != "":
+			matcher.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{ExactMatch: header.Value}
+		default:
+			matcher.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		}
+		match.Headers = append(match.Headers, matcher)
+	}
+
+	result := &route.Route{Match: match}
+
+	if r.Decorator != nil {
+		result.Decorator = &route.Decorator{Operation: r.Decorator.Operation}
+	}
+
+	if r.HostRedirect != "" || r.PathRedirect != "" {
+		redirect := &route.RedirectAction{HostRedirect: r.HostRedirect}
+		if r.PathRedirect != "" {
+			redirect.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{PathRedirect: r.PathRedirect}
+		}
+
+		result.Action = &route.Route_Redirect{Redirect: redirect}
+		return result
+	}
+
+	if r.DirectResponse != nil {
+		result.Action = &route.Route_DirectResponse{
+			DirectResponse: &route.DirectResponseAction{Status: uint32(r.DirectResponse.Status)},
+		}
+		return result
+	}
+
+	action := &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_Cluster{Cluster: r.Cluster},
+		PrefixRewrite:    r.PrefixRewrite,
+		Timeout:          durationProto(r.TimeoutMS),
+	}
+
+	if r.WeightedClusters != nil {
+		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{WeightedClusters: convertWeightedClusters(*r.WeightedClusters)}
+	}
+
+	switch {
+	case r.HostRewrite != "":
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewrite{HostRewrite: r.HostRewrite}
+	case r.AutoHostRewrite:
+		action.HostRewriteSpecifier = &route.RouteAction_AutoHostRewrite{AutoHostRewrite: &wrappers.BoolValue{Value: true}}
+	}
+
+	if r.RetryPolicy != nil {
+		action.RetryPolicy = &route.RetryPolicy{
+			RetryOn:       r.RetryPolicy.RetryOn,
+			NumRetries:    uint32Value(r.RetryPolicy.NumRetries),
+			PerTryTimeout: durationProto(r.RetryPolicy.PerTryTimeoutMS),
+		}
+	}
+
+	if r.Shadow != nil {
+		action.RequestMirrorPolicy = &route.RouteAction_RequestMirrorPolicy{
+			Cluster:    r.Shadow.Cluster,
+			RuntimeKey: r.Shadow.RuntimeKey,
+		}
+	}
+
+	if r.UseWebsocket {
+		action.UpgradeConfigs = []*route.RouteAction_UpgradeConfig{{UpgradeType: "websocket"}}
+	}
+
+	if r.HashPolicy != nil {
+		action.HashPolicy = []*route.RouteAction_HashPolicy{{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{HeaderName: r.HashPolicy.HeaderName},
+			},
+		}}
+	}
+
+	result.Action = &route.Route_Route{Route: action}
+	return result
+}
+
+// convertWeightedClusters will convert RDS v1 weighted clusters, which always
+// add up to 100
+func convertWeightedClusters(w rds.WeightedClusters) *route.WeightedCluster {
+	result := &route.WeightedCluster{
+		TotalWeight:      uint32Value(100),
+		RuntimeKeyPrefix: w.RuntimeKeyPrefix,
+	}
+
+	for _, cluster := range w.Clusters {
+		result.Clusters = append(result.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   cluster.Name,
+			Weight: &wrappers.UInt32Value{Value: uint32(cluster.Weight)},
+		})
+	}
+
+	return result
+}
+
+// socketAddress will return a TCP socket address
+func socketAddress(ip string, port int) *core.Address {
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol: core.SocketAddress_TCP,
+				Address:  ip,
+				PortSpecifier: &core.SocketAddress_PortValue{
+					PortValue: uint32(port),
+				},
+			},
+		},
+	}
+}
+
+// uint32Value will return a protobuf wrapper for positive values, and nil otherwise
+func uint32Value(value int) *wrappers.UInt32Value {
+	if value <= 0 {
+		return nil
+	}
+
+	return &wrappers.UInt32Value{Value: uint32(value)}
+}
+
+// percentValue will return a protobuf wrapper for a set percentage, including
+// 0, and nil otherwise
+func percentValue(value *int) *wrappers.UInt32Value {
+	if value == nil {
+		return nil
+	}
+
+	return &wrappers.UInt32Value{Value: uint32(*value)}
+}
+
+// durationProto will return a protobuf duration for positive durations, and nil otherwise
+func durationProto(d millis.Duration) *duration.Duration {
+	if d <= 0 {
+		return nil
+	}
+
+	return ptypes.DurationProto(time.Duration(d))
+}
@@ -0,0 +1,26 @@
+package xds
+
+import (
+	"testing"
+
+	"github.com/jippi/consul-envoy/service/cds"
+)
+
+func TestConvertClusterZeroPercent(t *testing.T) {
+	zero := 0
+	result := convertCluster(cds.Cluster{
+		Name:             "api",
+		Type:             "sds",
+		OutlierDetection: &cds.OutlierDetection{EnforcingSuccessRate: &zero},
+	})
+
+	od := result.OutlierDetection
+	if od.EnforcingSuccessRate == nil || od.EnforcingSuccessRate.Value != 0 {
+		t.Errorf("expected enforcing_success_rate 0, got %v", od.EnforcingSuccessRate)
+	}
+
+	// Unset percentages are left to Envoy
+	if od.MaxEjectionPercent != nil || od.EnforcingConsecutive_5Xx != nil || od.EnforcingConsecutiveGatewayFailure != nil {
+		t.Errorf("expected unset percentages to be nil, got %v", od)
+	}
+}
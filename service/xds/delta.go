@@ -0,0 +1,280 @@
+package xds
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+)
+
+// adsServer is the xDS server, answering incremental (delta) ADS streams
+// itself as the go-control-plane server only implements state of the world
+type adsServer struct {
+	xds.Server
+	worker *Worker
+}
+
+// DeltaAggregatedResources will serve an incremental ADS stream
+func (s adsServer) DeltaAggregatedResources(stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return s.worker.deltaStream(stream)
+}
+
+// deltaSubscription is the state of a resource type on a delta stream
+type deltaSubscription struct {
+	wildcard  bool             // Subscribed to all resources, CDS and LDS without resource names
+	names     map[string]bool  // Subscribed resource names, unless wildcard
+	sent      resourceVersions // Versions of the resources Envoy has, keyed by name
+	version   string           // Version of the resource type last diffed
+	responded bool             // Whether a response was sent, Envoy waits for the first one
+}
+
+// newDeltaSubscription will return the subscription of the first request for
+// a resource type, with the versions of the resources Envoy already has
+func newDeltaSubscription(request *v2.DeltaDiscoveryRequest) *deltaSubscription {
+	subscription := &deltaSubscription{
+		wildcard: len(request.ResourceNamesSubscribe) == 0 && (request.TypeUrl == cache.ClusterType || request.TypeUrl == cache.ListenerType),
+		names:    make(map[string]bool),
+		sent:     make(resourceVersions),
+	}
+	for name, version := range request.InitialResourceVersions {
+		subscription.sent[name] = version
+	}
+
+	return subscription
+}
+
+// subscribes will return true if the resource is subscribed to
+func (s *deltaSubscription) subscribes(name string) bool {
+	return s.wildcard || s.names[name]
+}
+
+// update will apply the resource names subscribed to and unsubscribed from by
+// a request. Unsubscribed resources are forgotten, so they are sent again when
+// subscribed to later
+func (s *deltaSubscription) update(subscribe, unsubscribe []string) {
+	for _, name := range subscribe {
+		s.names[name] = true
+		s.version = ""
+	}
+	for _, name := range unsubscribe {
+		delete(s.names, name)
+		delete(s.sent, name)
+	}
+}
+
+// deltaStream will serve an incremental xDS stream. Envoy subscribes to
+// resources per type and is only sent the resources that were added or
+// changed since the versions it has, and the names of the removed resources.
+//
+// Resources are assumed to be applied once sent, a NACK is only logged as
+// the resource is sent again when it changes
+func (w *Worker) deltaStream(stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	requests := make(chan *v2.DeltaDiscoveryRequest)
+	errs := make(chan error, 1)
+
+	go func() {
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case requests <- request:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	updates := w.updates.Subscribe()
+	defer w.updates.Unsubscribe(updates)
+
+	nodeID := ""
+	defer func() {
+		if nodeID != "" {
+			w.lock.Lock()
+			w.closeStream(nodeID)
+			w.lock.Unlock()
+		}
+	}()
+
+	subscriptions := make(map[string]*deltaSubscription)
+	nonce := 0
+
+	send := func(typeURL string, subscription *deltaSubscription) error {
+		response, ok, err := w.deltaResponse(nodeID, typeURL, subscription)
+		if err != nil || !ok {
+			return err
+		}
+
+		nonce++
+		response.Nonce = strconv.Itoa(nonce)
+		log.WithField("node", nodeID).WithField("type", typeURL).Debugf("Sending %d xDS resources, %d removed", len(response.Resources), len(response.RemovedResources))
+		return stream.Send(response)
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+
+		case <-updates:
+			for typeURL, subscription := range subscriptions {
+				if err := send(typeURL, subscription); err != nil {
+					return err
+				}
+			}
+
+		case request := <-requests:
+			if nodeID == "" {
+				if request.Node == nil || request.Node.Id == "" {
+					return fmt.Errorf("missing node id in the first delta request")
+				}
+
+				nodeID = request.Node.Id
+				w.lock.Lock()
+				w.register(nodeID, request.Node.Cluster).streams++
+				w.lock.Unlock()
+			}
+
+			logger := log.WithField("node", nodeID).WithField("type", request.TypeUrl)
+			if request.ErrorDetail != nil {
+				logger.Warnf("xDS resources rejected: %s", request.ErrorDetail.GetMessage())
+				continue
+			}
+
+			if !isResourceType(request.TypeUrl) {
+				logger.Warn("Ignoring delta request for an unknown resource type")
+				continue
+			}
+
+			subscription, ok := subscriptions[request.TypeUrl]
+			if !ok {
+				subscription = newDeltaSubscription(request)
+				subscriptions[request.TypeUrl] = subscription
+			}
+			subscription.update(request.ResourceNamesSubscribe, request.ResourceNamesUnsubscribe)
+
+			if err := send(request.TypeUrl, subscription); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deltaResponse will return the resources of a type added or changed for the
+// subscription and the names of the removed ones, false if there is nothing
+// to send. The subscription is updated as if the response was applied
+func (w *Worker) deltaResponse(nodeID, typeURL string, subscription *deltaSubscription) (*v2.DeltaDiscoveryResponse, bool, error) {
+	resources, versions, ok := w.groupResources(nodeID, typeURL)
+	if !ok {
+		// Nothing was built for the node yet, an update follows
+		return nil, false, nil
+	}
+
+	version := versions.version()
+	if subscription.responded && subscription.version == version {
+		return nil, false, nil
+	}
+
+	response := &v2.DeltaDiscoveryResponse{
+		TypeUrl:           typeURL,
+		SystemVersionInfo: version,
+	}
+
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !subscription.subscribes(name) || subscription.sent[name] == versions[name] {
+			continue
+		}
+
+		resource, err := ptypes.MarshalAny(resources[name])
+		if err != nil {
+			return nil, false, err
+		}
+
+		response.Resources = append(response.Resources, &v2.Resource{
+			Name:     name,
+			Version:  versions[name],
+			Resource: resource,
+		})
+	}
+
+	for name := range subscription.sent {
+		if _, ok := versions[name]; !ok || !subscription.subscribes(name) {
+			response.RemovedResources = append(response.RemovedResources, name)
+		}
+	}
+	sort.Strings(response.RemovedResources)
+
+	subscription.version = version
+	if subscription.responded && len(response.Resources)+len(response.RemovedResources) == 0 {
+		return nil, false, nil
+	}
+
+	for _, resource := range response.Resources {
+		subscription.sent[resource.Name] = resource.Version
+	}
+	for _, name := range response.RemovedResources {
+		delete(subscription.sent, name)
+	}
+	subscription.responded = true
+
+	return response, true, nil
+}
+
+// groupResources will return the resources of a type in the latest snapshot
+// of the group of a node, with their versions, false until the workers all
+// published and a snapshot was built
+func (w *Worker) groupResources(nodeID, typeURL string) (map[string]cache.Resource, resourceVersions, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.ready {
+		return nil, nil, false
+	}
+
+	n, ok := w.nodes[nodeID]
+	if !ok {
+		return nil, nil, false
+	}
+
+	g, ok := w.groups[n.group]
+	if !ok || g.versions == nil {
+		return nil, nil, false
+	}
+
+	// Snapshots are replaced, never modified, so they can be read unlocked
+	return g.snapshot.GetResources(typeURL), g.versions[typeURL], true
+}
+
+// isResourceType will return true if the resource type is served
+func isResourceType(typeURL string) bool {
+	for _, t := range resourceTypes {
+		if t == typeURL {
+			return true
+		}
+	}
+
+	return false
+}
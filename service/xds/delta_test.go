@@ -0,0 +1,176 @@
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+)
+
+// deltaWorker will return a worker with a single node in the "web" group,
+// ready to answer delta requests
+func deltaWorker() (*Worker, *group) {
+	g := &group{serviceCluster: "web", nodes: map[string]bool{"node-1": true}}
+	w := &Worker{
+		nodes:  map[string]*node{"node-1": {serviceCluster: "web", group: "web"}},
+		groups: map[string]*group{"web": g},
+		ready:  true,
+	}
+
+	return w, g
+}
+
+// setResources will replace the resources of a type in the snapshot of the group
+func setResources(t *testing.T, g *group, typeURL string, resources ...cache.Resource) {
+	versions, err := hashResources(resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.versions == nil {
+		g.versions = make(map[string]resourceVersions)
+	}
+	g.versions[typeURL] = versions
+
+	items := cache.NewResources(versions.version(), resources)
+	switch typeURL {
+	case cache.ClusterType:
+		g.snapshot.Clusters = items
+	case cache.EndpointType:
+		g.snapshot.Endpoints = items
+	}
+}
+
+// deltaNames will return the names of the resources in a delta response
+func deltaNames(response *v2.DeltaDiscoveryResponse) []string {
+	names := make([]string, 0, len(response.Resources))
+	for _, resource := range response.Resources {
+		names = append(names, resource.Name)
+	}
+
+	return names
+}
+
+func TestDeltaResponseWildcard(t *testing.T) {
+	w, g := deltaWorker()
+	setResources(t, g, cache.ClusterType, &v2.Cluster{Name: "web"}, &v2.Cluster{Name: "api"})
+
+	// CDS without resource names subscribes to all clusters
+	subscription := newDeltaSubscription(&v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType})
+	response, ok, err := w.deltaResponse("node-1", cache.ClusterType, subscription)
+	if err != nil || !ok {
+		t.Fatalf("expected an initial response, got %v, %v", ok, err)
+	}
+
+	if names := deltaNames(response); !reflect.DeepEqual(names, []string{"api", "web"}) {
+		t.Errorf("expected all clusters, got %v", names)
+	}
+	if response.SystemVersionInfo != g.versions[cache.ClusterType].version() {
+		t.Errorf("expected the version of the clusters, got %q", response.SystemVersionInfo)
+	}
+
+	// Nothing changed, nothing is sent
+	if _, ok, _ := w.deltaResponse("node-1", cache.ClusterType, subscription); ok {
+		t.Error("expected no response without changes")
+	}
+}
+
+func TestDeltaResponseInitialResourceVersions(t *testing.T) {
+	w, g := deltaWorker()
+	setResources(t, g, cache.ClusterType, &v2.Cluster{Name: "web"}, &v2.Cluster{Name: "api"})
+	versions := g.versions[cache.ClusterType]
+
+	// A reconnecting Envoy has the current api cluster and an outdated web cluster
+	subscription := newDeltaSubscription(&v2.DeltaDiscoveryRequest{
+		TypeUrl:                 cache.ClusterType,
+		InitialResourceVersions: map[string]string{"api": versions["api"], "web": "outdated"},
+	})
+
+	response, ok, err := w.deltaResponse("node-1", cache.ClusterType, subscription)
+	if err != nil || !ok {
+		t.Fatalf("expected a response, got %v, %v", ok, err)
+	}
+
+	if names := deltaNames(response); !reflect.DeepEqual(names, []string{"web"}) {
+		t.Errorf("expected only the outdated cluster, got %v", names)
+	}
+	if len(response.RemovedResources) != 0 {
+		t.Errorf("expected no removed clusters, got %v", response.RemovedResources)
+	}
+
+	// Envoy waits for a first response, even if it has all resources
+	subscription = newDeltaSubscription(&v2.DeltaDiscoveryRequest{
+		TypeUrl:                 cache.ClusterType,
+		InitialResourceVersions: map[string]string{"api": versions["api"], "web": versions["web"]},
+	})
+
+	response, ok, err = w.deltaResponse("node-1", cache.ClusterType, subscription)
+	if err != nil || !ok {
+		t.Fatalf("expected an empty first response, got %v, %v", ok, err)
+	}
+	if len(response.Resources)+len(response.RemovedResources) != 0 {
+		t.Errorf("expected no resources, got %v and removed %v", deltaNames(response), response.RemovedResources)
+	}
+}
+
+func TestDeltaResponseRemoved(t *testing.T) {
+	w, g := deltaWorker()
+	setResources(t, g, cache.ClusterType, &v2.Cluster{Name: "web"}, &v2.Cluster{Name: "api"})
+
+	subscription := newDeltaSubscription(&v2.DeltaDiscoveryRequest{TypeUrl: cache.ClusterType})
+	if _, _, err := w.deltaResponse("node-1", cache.ClusterType, subscription); err != nil {
+		t.Fatal(err)
+	}
+
+	setResources(t, g, cache.ClusterType, &v2.Cluster{Name: "api", LbPolicy: v2.Cluster_RANDOM})
+
+	response, ok, err := w.deltaResponse("node-1", cache.ClusterType, subscription)
+	if err != nil || !ok {
+		t.Fatalf("expected a response, got %v, %v", ok, err)
+	}
+
+	if names := deltaNames(response); !reflect.DeepEqual(names, []string{"api"}) {
+		t.Errorf("expected the changed cluster, got %v", names)
+	}
+	if !reflect.DeepEqual(response.RemovedResources, []string{"web"}) {
+		t.Errorf("expected the removed cluster, got %v", response.RemovedResources)
+	}
+	if _, ok := subscription.sent["web"]; ok {
+		t.Error("expected the removed cluster to be forgotten")
+	}
+}
+
+func TestDeltaResponseUnsubscribe(t *testing.T) {
+	w, g := deltaWorker()
+	setResources(t, g, cache.EndpointType, &v2.ClusterLoadAssignment{ClusterName: "web"}, &v2.ClusterLoadAssignment{ClusterName: "api"})
+
+	// EDS subscribes to the endpoints of the clusters by name
+	request := &v2.DeltaDiscoveryRequest{TypeUrl: cache.EndpointType, ResourceNamesSubscribe: []string{"api", "web"}}
+	subscription := newDeltaSubscription(request)
+	subscription.update(request.ResourceNamesSubscribe, nil)
+
+	if _, _, err := w.deltaResponse("node-1", cache.EndpointType, subscription); err != nil {
+		t.Fatal(err)
+	}
+
+	subscription.update(nil, []string{"web"})
+	if _, ok := subscription.sent["web"]; ok {
+		t.Fatal("expected the unsubscribed resource to be forgotten")
+	}
+
+	// The unsubscribed resource is not reported as removed, Envoy dropped it
+	if response, ok, _ := w.deltaResponse("node-1", cache.EndpointType, subscription); ok {
+		t.Errorf("expected no response after unsubscribing, got %v and removed %v", deltaNames(response), response.RemovedResources)
+	}
+
+	// Subscribing again sends the resource again
+	subscription.update([]string{"web"}, nil)
+	response, ok, err := w.deltaResponse("node-1", cache.EndpointType, subscription)
+	if err != nil || !ok {
+		t.Fatalf("expected a response, got %v, %v", ok, err)
+	}
+	if names := deltaNames(response); !reflect.DeepEqual(names, []string{"web"}) {
+		t.Errorf("expected the resubscribed resource, got %v", names)
+	}
+}
@@ -0,0 +1,117 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/jippi/consul-envoy/service/lds"
+)
+
+// convertListener will convert a LDS v1 listener to a v2 listener, HTTP
+// listeners using RDS get their route configuration over ADS
+func convertListener(l lds.Listener) (*v2.Listener, error) {
+	ip, port, err := parseAddress(l.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := make([]*listener.Filter, 0, len(l.Filters))
+	for _, filter := range l.Filters {
+		var name string
+		var config proto.Message
+
+		switch c := filter.Config.(type) {
+		case *lds.HTTPConnectionManager:
+			name = "envoy.http_connection_manager"
+			config = convertHTTPConnectionManager(c)
+		case *lds.TCPProxy:
+			name = "envoy.tcp_proxy"
+			config = convertTCPProxy(c)
+		default:
+			return nil, fmt.Errorf("unsupported filter %s in listener %s", filter.Name, l.Name)
+		}
+
+		typed, err := ptypes.MarshalAny(config)
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, &listener.Filter{
+			Name:       name,
+			ConfigType: &listener.Filter_TypedConfig{TypedConfig: typed},
+		})
+	}
+
+	return &v2.Listener{
+		Name:         l.Name,
+		Address:      socketAddress(ip, port),
+		FilterChains: []*listener.FilterChain{{Filters: filters}},
+	}, nil
+}
+
+// convertHTTPConnectionManager will convert a v1 HTTP connection manager,
+// using RDS over ADS or the inline route configuration
+func convertHTTPConnectionManager(c *lds.HTTPConnectionManager) *hcm.HttpConnectionManager {
+	manager := &hcm.HttpConnectionManager{
+		CodecType:  hcm.HttpConnectionManager_AUTO,
+		StatPrefix: c.StatPrefix,
+	}
+
+	if c.UseRemoteAddress {
+		manager.UseRemoteAddress = &wrappers.BoolValue{Value: true}
+	}
+
+	if c.RDS != nil {
+		manager.RouteSpecifier = &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource:    adsConfigSource,
+				RouteConfigName: c.RDS.RouteConfigName,
+			},
+		}
+	} else if c.RouteConfig != nil {
+		manager.RouteSpecifier = &hcm.HttpConnectionManager_RouteConfig{
+			RouteConfig: convertRouteConfiguration(c.StatPrefix, *c.RouteConfig),
+		}
+	}
+
+	for _, filter := range c.Filters {
+		manager.HttpFilters = append(manager.HttpFilters, &hcm.HttpFilter{Name: "envoy." + filter.Name})
+	}
+
+	return manager
+}
+
+// convertTCPProxy will convert a v1 TCP proxy, which always has a single
+// route in the listeners generated by LDS
+func convertTCPProxy(c *lds.TCPProxy) *tcp.TcpProxy {
+	proxy := &tcp.TcpProxy{StatPrefix: c.StatPrefix}
+	if len(c.RouteConfig.Routes) > 0 {
+		proxy.ClusterSpecifier = &tcp.TcpProxy_Cluster{Cluster: c.RouteConfig.Routes[0].Cluster}
+	}
+
+	return proxy
+}
+
+// parseAddress will split a v1 "tcp://<ip>:<port>" address
+func parseAddress(address string) (string, int, error) {
+	host, portValue, err := net.SplitHostPort(strings.TrimPrefix(address, "tcp://"))
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in address %s", address)
+	}
+
+	return host, port, nil
+}
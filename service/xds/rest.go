@@ -0,0 +1,82 @@
+package xds
+
+import (
+	"context"
+	"net/http"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/jsonpb"
+	log "github.com/sirupsen/logrus"
+)
+
+// restTypes maps the xDS v2 REST-JSON discovery paths to their resource type
+var restTypes = map[string]string{
+	"clusters":  cache.ClusterType,
+	"endpoints": cache.EndpointType,
+	"routes":    cache.RouteType,
+	"listeners": cache.ListenerType,
+}
+
+// RESTHandler will return the HTTP handler for a xDS v2 REST-JSON discovery
+// endpoint (POST /v2/discovery:<resource>), resource is one of "clusters",
+// "endpoints", "routes" or "listeners"
+func (w *Worker) RESTHandler(resource string) http.HandlerFunc {
+	typeURL, ok := restTypes[resource]
+	if !ok {
+		log.Fatalf("Unknown xDS REST resource: %s", resource)
+	}
+
+	return func(rw http.ResponseWriter, r *http.Request) {
+		request := &v2.DiscoveryRequest{}
+		if err := jsonpb.Unmarshal(r.Body, request); err != nil {
+			http.Error(rw, "Invalid DiscoveryRequest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Node == nil || request.Node.Id == "" {
+			http.Error(rw, "Missing node id in DiscoveryRequest", http.StatusBadRequest)
+			return
+		}
+
+		request.TypeUrl = typeURL
+		logger := log.WithField("node", request.Node.Id).WithField("type", resource)
+		logger.Debugf("/v2/discovery:%s", resource)
+
+		// Envoy treats 304 as "no changes", so polling with an up to date
+		// version does not transfer the resources again (but still counts as
+		// a fetch, keeping the node)
+		w.fetched(request.Node.Id, request.Node.Cluster)
+		if request.VersionInfo != "" && request.VersionInfo == w.currentVersion(request.Node.Id, typeURL) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		response, err := w.fetch(r.Context(), resource, request)
+		if err != nil {
+			logger.Error(err)
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		marshaler := jsonpb.Marshaler{OrigName: true}
+		if err := marshaler.Marshal(rw, response); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// fetch will answer a REST discovery request with the xDS server
+func (w *Worker) fetch(ctx context.Context, resource string, request *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error) {
+	switch resource {
+	case "clusters":
+		return w.server.FetchClusters(ctx, request)
+	case "endpoints":
+		return w.server.FetchEndpoints(ctx, request)
+	case "routes":
+		return w.server.FetchRoutes(ctx, request)
+	default:
+		return w.server.FetchListeners(ctx, request)
+	}
+}
@@ -0,0 +1,80 @@
+package xds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/proto"
+)
+
+// resourceTypes are the xDS resource types served, in snapshot order
+var resourceTypes = []string{
+	cache.EndpointType,
+	cache.ClusterType,
+	cache.RouteType,
+	cache.ListenerType,
+}
+
+// resourceVersions are the content hashes of the resources of a single type,
+// keyed by resource name
+type resourceVersions map[string]string
+
+// hashResources will return the content hash of each resource, resources
+// are marshalled deterministically so equal resources get equal hashes
+func hashResources(items []cache.Resource) (resourceVersions, error) {
+	versions := make(resourceVersions, len(items))
+
+	for _, item := range items {
+		buffer := proto.NewBuffer(nil)
+		buffer.SetDeterministic(true)
+		if err := buffer.Marshal(item); err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(buffer.Bytes())
+		versions[cache.GetResourceName(item)] = hex.EncodeToString(sum[:8])
+	}
+
+	return versions, nil
+}
+
+// version will return the version of the resource type, which only changes
+// when a resource is added, changed or removed
+func (v resourceVersions) version() string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + "=" + v[name] + "\n"))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// diff will return the names of the resources added, changed and removed
+// compared to the previous versions
+func (v resourceVersions) diff(previous resourceVersions) (added, changed, removed []string) {
+	for name, version := range v {
+		previousVersion, ok := previous[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case previousVersion != version:
+			changed = append(changed, name)
+		}
+	}
+
+	for name := range previous {
+		if _, ok := v[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	return added, changed, removed
+}
@@ -0,0 +1,463 @@
+package xds
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server"
+	"github.com/jippi/consul-envoy/service/cds"
+	"github.com/jippi/consul-envoy/service/lds"
+	"github.com/jippi/consul-envoy/service/notify"
+	"github.com/jippi/consul-envoy/service/policy"
+	"github.com/jippi/consul-envoy/service/rds"
+	"github.com/jippi/consul-envoy/service/sds"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// fetchTimeout is how long a node only using REST fetches is kept after its
+// last fetch, as REST has no streams to tell when the node is gone
+const fetchTimeout = 1 * time.Hour
+
+// Worker for the xDS v2 (CDS, EDS, RDS and LDS) management server, building
+// snapshots from the CDS, RDS, SDS and LDS worker responses, scoped by the
+// policy of each Envoy service cluster
+type Worker struct {
+	cds     *cds.Worker         // CDS worker, source of clusters
+	rds     *rds.Worker         // RDS worker, source of routes
+	sds     *sds.Worker         // SDS worker, source of endpoints
+	lds     *lds.Worker         // LDS worker, source of listeners
+	policy  *policy.Worker      // Policy worker, scoping clusters and routes per service cluster
+	cache   cache.SnapshotCache // Snapshot cache, one snapshot per node
+	server  xds.Server          // xDS server, shared by gRPC and REST
+	stopCh  chan interface{}    // Stop channel
+	lock    sync.Mutex          // Lock for nodes, streams and groups
+	nodes   map[string]*node    // Envoy nodes that connected, keyed by node ID
+	streams map[int64]string    // Node ID of the open gRPC streams, keyed by stream ID
+	groups  map[string]*group   // Node groups, keyed by service cluster (and node in sidecar mode)
+	ready   bool                // Whether the CDS, RDS, SDS and LDS workers all published a response
+	updates notify.Notifier     // Notifies delta streams about new snapshots
+}
+
+// node is an Envoy node, kept while it has open gRPC streams or recently
+// fetched resources over REST
+type node struct {
+	serviceCluster string    // Service cluster of the node
+	group          string    // Key of the group of the node
+	streams        int       // Number of open gRPC streams
+	lastFetch      time.Time // Time of the latest REST fetch, zero if none
+}
+
+// group of Envoy nodes sharing a service cluster, and therefore a snapshot.
+// In sidecar mode every node has its own group, as endpoints depend on the node
+type group struct {
+	serviceCluster string                      // Service cluster of the nodes
+	node           string                      // Node ID in sidecar mode, otherwise empty
+	nodes          map[string]bool             // IDs of the nodes in the group
+	snapshot       cache.Snapshot              // Latest snapshot
+	versions       map[string]resourceVersions // Resource versions of the latest snapshot, keyed by type
+}
+
+// NewWorker will return the struct for a xDS worker
+func NewWorker(cdsWorker *cds.Worker, rdsWorker *rds.Worker, sdsWorker *sds.Worker, ldsWorker *lds.Worker, policyWorker *policy.Worker) *Worker {
+	w := &Worker{
+		cds:     cdsWorker,
+		rds:     rdsWorker,
+		sds:     sdsWorker,
+		lds:     ldsWorker,
+		policy:  policyWorker,
+		stopCh:  make(chan interface{}),
+		nodes:   make(map[string]*node),
+		streams: make(map[int64]string),
+		groups:  make(map[string]*group),
+	}
+
+	w.cache = cache.NewSnapshotCache(true, cache.IDHash{}, log.WithField("component", "xds"))
+	w.server = adsServer{Server: xds.NewServer(w.cache, w), worker: w}
+	return w
+}
+
+// Start will start the xDS worker, building new snapshots each time the CDS,
+// RDS, SDS or LDS responses or the policies change. No snapshot is built until
+// the CDS, RDS, SDS and LDS workers all published, as Envoy would otherwise
+// (re)connect to empty resources and drop its configuration
+func (w *Worker) Start() {
+	cdsCh := w.cds.Subscribe()
+	rdsCh := w.rds.Subscribe()
+	sdsCh := w.sds.Subscribe()
+	ldsCh := w.lds.Subscribe()
+	policyCh := w.policy.Subscribe()
+	cleanup := time.NewTicker(10 * time.Minute)
+	published := make(map[string]bool)
+
+	for {
+		select {
+		case <-w.stopCh:
+			cleanup.Stop()
+			return
+
+		case <-cleanup.C:
+			w.expireFetchNodes()
+			continue
+
+		case <-cdsCh:
+			published["cds"] = true
+		case <-rdsCh:
+			published["rds"] = true
+		case <-sdsCh:
+			published["sds"] = true
+		case <-ldsCh:
+			published["lds"] = true
+		case <-policyCh:
+		}
+
+		if len(published) < 4 {
+			log.Debug("Waiting for all workers to publish before building xDS snapshots")
+			continue
+		}
+
+		// Changes tend to arrive in bursts (e.g. all SDS builders starting),
+		// so wait a bit to include them in a single snapshot
+		time.Sleep(100 * time.Millisecond)
+
+		w.update()
+	}
+}
+
+// Stop the xDS worker
+func (w *Worker) Stop() {
+	close(w.stopCh)
+}
+
+// Serve will serve the xDS gRPC services (ADS, CDS, EDS, RDS and LDS) on the listener
+func (w *Worker) Serve(listener net.Listener) error {
+	grpcServer := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, w.server)
+	v2.RegisterClusterDiscoveryServiceServer(grpcServer, w.server)
+	v2.RegisterEndpointDiscoveryServiceServer(grpcServer, w.server)
+	v2.RegisterRouteDiscoveryServiceServer(grpcServer, w.server)
+	v2.RegisterListenerDiscoveryServiceServer(grpcServer, w.server)
+
+	return grpcServer.Serve(listener)
+}
+
+// update will build a new snapshot for every node group, once all workers
+// published
+func (w *Worker) update() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.ready {
+		log.Info("All workers published, building xDS snapshots")
+		w.ready = true
+	}
+
+	for _, g := range w.groups {
+		w.updateGroup(g)
+	}
+}
+
+// updateGroup will build a new snapshot for a node group and set it for all
+// nodes in the group, unless no resource changed since the previous snapshot
+// or the workers did not all publish yet. The lock must be held
+func (w *Worker) updateGroup(g *group) {
+	if !w.ready {
+		return
+	}
+
+	logger := log.WithField("service_cluster", g.serviceCluster)
+	if g.node != "" {
+		logger = logger.WithField("node", g.node)
+	}
+
+	resources := w.buildResources(g)
+
+	versions := make(map[string]resourceVersions, len(resources))
+	for typeURL, items := range resources {
+		hashes, err := hashResources(items)
+		if err != nil {
+			logger.Errorf("Could not hash xDS resources: %s", err)
+			return
+		}
+		versions[typeURL] = hashes
+	}
+
+	changes := 0
+	for _, typeURL := range resourceTypes {
+		added, changed, removed := versions[typeURL].diff(g.versions[typeURL])
+		if len(added)+len(changed)+len(removed) == 0 {
+			continue
+		}
+
+		changes++
+		logger.WithField("type", typeURL).Infof("xDS resources changed: %d added, %d changed, %d removed", len(added), len(changed), len(removed))
+	}
+
+	if changes == 0 && g.versions != nil {
+		logger.Debug("No xDS resources changed")
+		return
+	}
+
+	// Every resource type is versioned by its own content, so Envoy is only
+	// sent the resource types that actually changed
+	g.versions = versions
+	g.snapshot = cache.Snapshot{
+		Endpoints: cache.NewResources(versions[cache.EndpointType].version(), resources[cache.EndpointType]),
+		Clusters:  cache.NewResources(versions[cache.ClusterType].version(), resources[cache.ClusterType]),
+		Routes:    cache.NewResources(versions[cache.RouteType].version(), resources[cache.RouteType]),
+		Listeners: cache.NewResources(versions[cache.ListenerType].version(), resources[cache.ListenerType]),
+	}
+
+	for node := range g.nodes {
+		w.setSnapshot(node, g.snapshot)
+	}
+	w.updates.Notify()
+}
+
+// currentVersion will return the version of the latest snapshot of a node for
+// a resource type, empty if the node has no snapshot yet
+func (w *Worker) currentVersion(node, typeURL string) string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n, ok := w.nodes[node]
+	if !ok {
+		return ""
+	}
+
+	g, ok := w.groups[n.group]
+	if !ok || g.versions == nil {
+		return ""
+	}
+
+	return g.snapshot.GetVersion(typeURL)
+}
+
+// register will add a node to the group of its service cluster and set the
+// snapshot of the group for the node, the first time the node is seen or when
+// its service cluster changed. The lock must be held
+func (w *Worker) register(id, serviceCluster string) *node {
+	n, ok := w.nodes[id]
+	if ok && n.serviceCluster == serviceCluster {
+		return n
+	}
+
+	logger := log.WithField("node", id).WithField("service_cluster", serviceCluster)
+	if ok {
+		logger.Infof("xDS node moved from service cluster %s", n.serviceCluster)
+		w.leaveGroup(id, n)
+	} else {
+		logger.Info("New xDS node")
+		n = &node{}
+		w.nodes[id] = n
+	}
+
+	key := serviceCluster
+	if w.sds.Sidecar().Enabled() {
+		key = sds.SidecarServiceName(serviceCluster, id)
+	}
+	n.serviceCluster = serviceCluster
+	n.group = key
+
+	g, ok := w.groups[key]
+	if !ok {
+		g = &group{serviceCluster: serviceCluster, nodes: map[string]bool{id: true}}
+		if w.sds.Sidecar().Enabled() {
+			g.node = id
+		}
+
+		w.groups[key] = g
+		w.updateGroup(g)
+		return n
+	}
+
+	g.nodes[id] = true
+	if g.versions != nil {
+		w.setSnapshot(id, g.snapshot)
+	}
+
+	return n
+}
+
+// unregister will remove a node and its snapshot, the lock must be held
+func (w *Worker) unregister(id string) {
+	n, ok := w.nodes[id]
+	if !ok {
+		return
+	}
+
+	log.WithField("node", id).WithField("service_cluster", n.serviceCluster).Info("xDS node gone")
+	w.leaveGroup(id, n)
+	delete(w.nodes, id)
+	w.cache.ClearSnapshot(id)
+}
+
+// closeStream will remove a node once its last stream closed, unless it
+// recently fetched resources over REST. The lock must be held
+func (w *Worker) closeStream(id string) {
+	n, ok := w.nodes[id]
+	if !ok {
+		return
+	}
+
+	n.streams--
+	if n.streams == 0 && n.lastFetch.Before(time.Now().Add(-fetchTimeout)) {
+		w.unregister(id)
+	}
+}
+
+// leaveGroup will remove a node from its group, and the group once it has no
+// nodes left. The lock must be held
+func (w *Worker) leaveGroup(id string, n *node) {
+	g, ok := w.groups[n.group]
+	if !ok {
+		return
+	}
+
+	delete(g.nodes, id)
+	if len(g.nodes) == 0 {
+		delete(w.groups, n.group)
+	}
+}
+
+// expireFetchNodes will remove the nodes without open streams that did not
+// fetch resources over REST within the fetch timeout
+func (w *Worker) expireFetchNodes() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	timeout := time.Now().Add(-fetchTimeout)
+	for id, n := range w.nodes {
+		if n.streams == 0 && n.lastFetch.Before(timeout) {
+			w.unregister(id)
+		}
+	}
+}
+
+// setSnapshot will set the snapshot for a node
+func (w *Worker) setSnapshot(node string, snapshot cache.Snapshot) {
+	if err := w.cache.SetSnapshot(node, snapshot); err != nil {
+		log.WithField("node", node).Errorf("Could not set xDS snapshot: %s", err)
+	}
+}
+
+// buildResources will convert the current CDS, RDS, SDS and LDS responses to
+// xDS resources for a node group, keyed by resource type. Clusters, endpoints,
+// routes and listeners are limited to the clusters allowed by the policy of the
+// group, and in sidecar mode endpoints are prioritized for the node of the group
+func (w *Worker) buildResources(g *group) map[string][]cache.Resource {
+	p := w.policy.Policy(g.serviceCluster)
+	sidecar := w.sds.Sidecar()
+
+	clusters := make([]cache.Resource, 0)
+	for _, cluster := range w.cds.Response().Scoped(p.Allows).Clusters {
+		clusters = append(clusters, convertCluster(cluster))
+	}
+
+	if g.node != "" {
+		if inbound := w.sds.NodeHosts(g.serviceCluster, g.node); len(inbound) > 0 {
+			clusters = append(clusters, convertCluster(cds.InboundCluster(g.serviceCluster, inbound)))
+		}
+	}
+
+	endpoints := make([]cache.Resource, 0)
+	for name, response := range w.sds.Responses() {
+		if p.Allows(name) {
+			endpoints = append(endpoints, convertEndpoints(name, sidecar.Priorities(response.Hosts, g.node)))
+		}
+	}
+
+	routes := make([]cache.Resource, 0)
+	for name, response := range w.rds.Responses() {
+		routes = append(routes, convertRouteConfiguration(name, response.Scoped(p.Allows)))
+	}
+
+	listeners := make([]cache.Resource, 0)
+	for _, l := range w.lds.Response().Scoped(p.Allows).Listeners {
+		listener, err := convertListener(l)
+		if err != nil {
+			log.WithField("listener", l.Name).Errorf("Could not convert listener: %s", err)
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return map[string][]cache.Resource{
+		cache.EndpointType: endpoints,
+		cache.ClusterType:  clusters,
+		cache.RouteType:    routes,
+		cache.ListenerType: listeners,
+	}
+}
+
+// OnStreamOpen is called once an xDS stream is open
+func (w *Worker) OnStreamOpen(ctx context.Context, id int64, typeURL string) error {
+	log.Debugf("xDS stream %d open for %s", id, typeURL)
+	return nil
+}
+
+// OnStreamClosed is called immediately prior to closing an xDS stream, the
+// node of the stream is removed once its last stream closed
+func (w *Worker) OnStreamClosed(id int64) {
+	log.Debugf("xDS stream %d closed", id)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	nodeID, ok := w.streams[id]
+	if !ok {
+		return
+	}
+	delete(w.streams, id)
+
+	w.closeStream(nodeID)
+}
+
+// OnStreamRequest is called once a request is received on a stream, the node
+// is only sent on the first request of a stream by some Envoy versions
+func (w *Worker) OnStreamRequest(id int64, request *v2.DiscoveryRequest) error {
+	if request.Node == nil {
+		return nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n := w.register(request.Node.Id, request.Node.Cluster)
+	if _, ok := w.streams[id]; !ok {
+		w.streams[id] = request.Node.Id
+		n.streams++
+	}
+
+	return nil
+}
+
+// OnStreamResponse is called immediately prior to sending a response on a stream
+func (w *Worker) OnStreamResponse(id int64, request *v2.DiscoveryRequest, response *v2.DiscoveryResponse) {
+}
+
+// OnFetchRequest is called for each REST fetch request
+func (w *Worker) OnFetchRequest(ctx context.Context, request *v2.DiscoveryRequest) error {
+	if request.Node != nil {
+		w.fetched(request.Node.Id, request.Node.Cluster)
+	}
+	return nil
+}
+
+// fetched will register a node fetching resources over REST, keeping it until
+// the fetch timeout passed without fetches
+func (w *Worker) fetched(id, serviceCluster string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.register(id, serviceCluster).lastFetch = time.Now()
+}
+
+// OnFetchResponse is called immediately prior to sending a REST fetch response
+func (w *Worker) OnFetchResponse(request *v2.DiscoveryRequest, response *v2.DiscoveryResponse) {
+}